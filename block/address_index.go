@@ -0,0 +1,158 @@
+package block
+
+import (
+	"fmt"
+	"sync"
+)
+
+// AddressTxOut is an output paid to an address, together with the input
+// that spent it once it is spent.
+type AddressTxOut struct {
+	TxOutId    string       `json:"txOutId"`
+	TxOutIndex int64        `json:"txOutIndex"`
+	Amount     int64        `json:"amount"`
+	BlockIndex int64        `json:"blockIndex"`
+	SpentBy    *AddressTxIn `json:"spentBy,omitempty"`
+}
+
+// AddressTxIn locates the input that spent an AddressTxOut.
+type AddressTxIn struct {
+	TxId       string `json:"txId"`
+	TxInIndex  int    `json:"txInIndex"`
+	BlockIndex int64  `json:"blockIndex"`
+}
+
+// addressIndex records every output of the main chain by address. It is
+// only maintained once enabled, as it keeps the whole history in memory.
+type addressIndex struct {
+	mutex      sync.RWMutex
+	enabled    bool
+	txOuts     map[string][]*AddressTxOut
+	byOutpoint map[string]*AddressTxOut
+}
+
+func outpointKey(txOutId string, txOutIndex int64) string {
+	return fmt.Sprintf("%s:%d", txOutId, txOutIndex)
+}
+
+func (index *addressIndex) rebuild(blocks []Block) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if !index.enabled {
+		return
+	}
+
+	index.txOuts = make(map[string][]*AddressTxOut)
+	index.byOutpoint = make(map[string]*AddressTxOut)
+	for _, block := range blocks {
+		index.add(block)
+	}
+}
+
+func (index *addressIndex) addBlock(block Block) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if !index.enabled {
+		return
+	}
+
+	index.add(block)
+}
+
+func (index *addressIndex) add(block Block) {
+	for _, transaction := range block.Data {
+		for txInIndex, txIn := range transaction.TxIns {
+			if spent, found := index.byOutpoint[outpointKey(txIn.TxOutId, txIn.TxOutIndex)]; found {
+				spent.SpentBy = &AddressTxIn{
+					TxId:       transaction.Id,
+					TxInIndex:  txInIndex,
+					BlockIndex: block.Index,
+				}
+			}
+		}
+
+		for txOutIndex, txOut := range transaction.TxOuts {
+			entry := &AddressTxOut{
+				TxOutId:    transaction.Id,
+				TxOutIndex: int64(txOutIndex),
+				Amount:     txOut.Amount,
+				BlockIndex: block.Index,
+			}
+			index.txOuts[txOut.Address] = append(index.txOuts[txOut.Address], entry)
+			index.byOutpoint[outpointKey(entry.TxOutId, entry.TxOutIndex)] = entry
+		}
+	}
+}
+
+// removeBlock forgets the outputs created by block, which must be the last
+// indexed one, and marks the outputs it spent as unspent again.
+func (index *addressIndex) removeBlock(block Block) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if !index.enabled {
+		return
+	}
+
+	for _, transaction := range block.Data {
+		for _, txOut := range transaction.TxOuts {
+			entries := index.txOuts[txOut.Address]
+			for len(entries) > 0 && entries[len(entries)-1].BlockIndex == block.Index {
+				last := entries[len(entries)-1]
+				delete(index.byOutpoint, outpointKey(last.TxOutId, last.TxOutIndex))
+				entries = entries[:len(entries)-1]
+			}
+			index.txOuts[txOut.Address] = entries
+		}
+
+		for _, txIn := range transaction.TxIns {
+			if spent, found := index.byOutpoint[outpointKey(txIn.TxOutId, txIn.TxOutIndex)]; found {
+				spent.SpentBy = nil
+			}
+		}
+	}
+}
+
+// history returns up to limit outputs of address, newest first, skipping
+// the first offset ones, and the total number of outputs recorded.
+func (index *addressIndex) history(address string, offset int, limit int) ([]AddressTxOut, int) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	entries := index.txOuts[address]
+	total := len(entries)
+
+	page := make([]AddressTxOut, 0)
+	for i := total - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, *entries[i])
+	}
+
+	return page, total
+}
+
+var addrIdx = &addressIndex{}
+
+// EnableAddressIndex turns on the address index. It is built from the
+// current chain, and kept up to date from then on.
+func EnableAddressIndex() {
+	addrIdx.mutex.Lock()
+	addrIdx.enabled = true
+	addrIdx.mutex.Unlock()
+
+	addrIdx.rebuild(GetBlockchain())
+}
+
+func IsAddressIndexEnabled() bool {
+	addrIdx.mutex.RLock()
+	defer addrIdx.mutex.RUnlock()
+
+	return addrIdx.enabled
+}
+
+// GetAddressHistory pages through the outputs ever paid to address, newest
+// first, and tells how many there are in total.
+func GetAddressHistory(address string, offset int, limit int) ([]AddressTxOut, int) {
+	return addrIdx.history(address, offset, limit)
+}
@@ -1,13 +1,7 @@
 package block
 
 import (
-	"crypto/sha256"
-	"time"
 	"fmt"
-	. "github.com/ahmetb/go-linq"
-	"strconv"
-	"strings"
-	"math"
 	"github.com/go-naivecoin/tx"
 	"encoding/json"
 	"bytes"
@@ -15,6 +9,10 @@ import (
 	"github.com/pkg/errors"
 	"encoding/gob"
 	"log"
+	"github.com/go-naivecoin/params"
+	"context"
+	"sort"
+	"sync"
 )
 
 type Block struct {
@@ -22,18 +20,23 @@ type Block struct {
 	Hash         string            `json:"hash"`
 	PreviousHash string            `json:"previousHash"`
 	Timestamp    int64             `json:"timestamp"`
+	MerkleRoot   string            `json:"merkleRoot"`
 	Data         [] tx.Transaction `json:"data"`
-	Difficulty   int               `json:"difficulty"`
+	Bits         uint32            `json:"bits"`
 	Nonce        int64             `json:"nonce"`
 }
 
-const (
-	BLOCK_GENERATION_INTERVAL      int = 10
-	DIFFICULTY_ADJUSTMENT_INTERVAL int = 10
-)
-
-func NewBlock(index int64, hash string, previousHash string, timestamp int64, data []tx.Transaction, difficulty int, nonce int64) Block {
-	block := Block{index, hash, previousHash, timestamp, data, difficulty, nonce}
+func NewBlock(index int64, hash string, previousHash string, timestamp int64, data []tx.Transaction, bits uint32, nonce int64) Block {
+	block := Block{
+		Index:        index,
+		Hash:         hash,
+		PreviousHash: previousHash,
+		Timestamp:    timestamp,
+		MerkleRoot:   CalculateMerkleRoot(data),
+		Data:         data,
+		Bits:         bits,
+		Nonce:        nonce,
+	}
 
 	if block.Hash == "" {
 		block.Hash = block.calculateHashForBlock()
@@ -42,74 +45,132 @@ func NewBlock(index int64, hash string, previousHash string, timestamp int64, da
 	return block
 }
 
-var genesisTransaction = tx.Transaction{
-	TxIns:  []tx.TxIn{tx.TxIn{Signature: "", TxOutId: "", TxOutIndex: 0}},
-	TxOuts: []tx.TxOut{{Address: "04bfcab8722991ae774db48f934ca79cfb7dd991229153b9f732ba5334aafcd8e7266e47076996b55a14bf9913ee3145ce0cfc1372ada8ada74bd287450313534a", Amount: 50}},
-	Id:     "e655f6a5f26dc9b4cac6e46f52336428287759cf81ef5ff10854f69d68f43fa3",
+// newGenesisBlock builds the genesis block of a network, which pays the
+// coinbase amount to its genesis address. Its hash is always calculated,
+// InitBlockStore checks it against a pinned GenesisHash.
+func newGenesisBlock(chainParams *params.ChainParams) Block {
+	genesisTransaction := tx.GetCoinbaseTransaction(chainParams.GenesisAddress, 0)
+	return NewBlock(0, "", "", chainParams.GenesisTimestamp, []tx.Transaction{genesisTransaction}, chainParams.GenesisBits, chainParams.GenesisNonce)
 }
 
-var genesisBlock = NewBlock(0, "91a73664bc84c0baa1fc75ea6e4aa6d1d20c5df664c724e3159aefc2e1186627", "", 1465154705, []tx.Transaction{genesisTransaction}, 1, 0)
+var genesisBlock = newGenesisBlock(params.Active())
 
-var blockchain = []Block{genesisBlock}
+var store BlockStore = NewMemoryBlockStore(genesisBlock)
 
 var emptyUtxos = make([]tx.UnspentTxOut, 0)
-var unspentTxOuts, _ = tx.ProcessTransactions(blockchain[0].Data, emptyUtxos, 0)
+var unspentTxOuts, _ = tx.ProcessTransactions(genesisBlock.Data, emptyUtxos, 0, 0)
+
+// utxoMutex guards unspentTxOuts, which is read without chainMutex.
+var utxoMutex sync.Mutex
+
+// dataDirectory is where the chain and the unspent transaction outputs are
+// persisted, empty when they only live in memory.
+var dataDirectory string
+
+// InitBlockStore starts the chain of the active network from a file backed
+// store under dataDir and restores the unspent transaction outputs saved for
+// its tip, rebuilding them from the stored blocks if they are missing or
+// stale. An empty dataDir keeps the chain in memory.
+func InitBlockStore(dataDir string) error {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	genesis := newGenesisBlock(params.Active())
+	if pinned := params.Active().GenesisHash; pinned != "" && pinned != genesis.Hash {
+		return errors.Errorf("genesis hash %s of %s does not match its block %s", pinned, params.Active().Name, genesis.Hash)
+	}
+	genesisBlock = genesis
+
+	if dataDir == "" {
+		dataDirectory = ""
+		store = NewMemoryBlockStore(genesisBlock)
+		undoStore = NewMemoryUndoStore()
+		tree = newBlockTree(store.Blocks())
+		resetRejected()
+		reindexChain(store.Blocks())
+		aUnspentTxOuts, _ := isValidChain(store.Blocks())
+		SetUnpentTxOuts(aUnspentTxOuts)
+		notifyTipChanged()
+		return nil
+	}
+
+	fileStore, err := NewFileBlockStore(dataDir, genesisBlock)
+	if err != nil {
+		return err
+	}
+
+	fileUndoStore, err := NewFileUndoStore(dataDir)
+	if err != nil {
+		fileStore.Close()
+		return err
+	}
+
+	tip := fileStore.Latest()
+	bestHash, aUnspentTxOuts, err := loadUnspentTxOuts(dataDir)
+	if err != nil {
+		log.Printf("could not load unspent transaction outputs: %s", err.Error())
+	}
+
+	if err != nil || bestHash != tip.Hash {
+		log.Printf("unspent transaction outputs do not match tip %s, rebuilding them from the blockchain", tip.Hash)
+		aUnspentTxOuts, err = isValidChain(fileStore.Blocks())
+		if err != nil {
+			fileStore.Close()
+			return errors.Wrapf(err, "stored blockchain in %s is invalid", dataDir)
+		}
+	}
+
+	store = fileStore
+	undoStore = fileUndoStore
+	dataDirectory = dataDir
+	tree = newBlockTree(store.Blocks())
+	resetRejected()
+	reindexChain(store.Blocks())
+	SetUnpentTxOuts(aUnspentTxOuts)
+	tx.UpdateTransactionPool(aUnspentTxOuts, tip.Index+1, tipMedianTime())
+	notifyTipChanged()
+
+	log.Printf("blockchain restored at index %d, hash %s", tip.Index, tip.Hash)
+	return nil
+}
 
 func GetUnpentTxOuts() tx.UnspentTxOuts {
 	var utxos tx.UnspentTxOuts
 	var buff bytes.Buffer
+	utxoMutex.Lock()
 	gob.NewEncoder(&buff).Encode(unspentTxOuts)
+	utxoMutex.Unlock()
 	gob.NewDecoder(bytes.NewBuffer(buff.Bytes())).Decode(&utxos)
 	return utxos
 }
 
 func SetUnpentTxOuts(newUtxos tx.UnspentTxOuts) {
 	log.Printf("replacing unspentTxouts with: %v", newUtxos)
+	utxoMutex.Lock()
 	unspentTxOuts = newUtxos
+	utxoMutex.Unlock()
+
+	if dataDirectory != "" {
+		if err := saveUnspentTxOuts(dataDirectory, GetLatestBlock().Hash, newUtxos); err != nil {
+			log.Printf("could not save unspent transaction outputs: %s", err.Error())
+		}
+	}
 }
 
 func GetBlockchain() []Block {
-	return blockchain
+	return store.Blocks()
 }
 
 func GetLatestBlock() Block {
-	return From(blockchain).Last().(Block)
-}
-
-func getDifficulty(aBlockchain []Block) int {
-	latestBlock := GetLatestBlock()
-	if latestBlock.Index%(int64(DIFFICULTY_ADJUSTMENT_INTERVAL)) == 0 && latestBlock.Index != 0 {
-		return getAdjustedDifficulty(latestBlock, aBlockchain)
-	} else {
-		return latestBlock.Difficulty
-	}
+	return store.Latest()
 }
-func getAdjustedDifficulty(latestBlock Block, aBlockchain []Block) int {
-	prevAdjustmentBlock := blockchain[len(blockchain)-DIFFICULTY_ADJUSTMENT_INTERVAL]
-	timeExpected := int64(BLOCK_GENERATION_INTERVAL * DIFFICULTY_ADJUSTMENT_INTERVAL)
-	timeTaken := latestBlock.Timestamp - prevAdjustmentBlock.Timestamp
 
-	if timeTaken < timeExpected/2 {
-		return prevAdjustmentBlock.Difficulty + 1
-	} else if timeTaken > timeExpected*2 {
-		return prevAdjustmentBlock.Difficulty - 1
-	} else {
-		return prevAdjustmentBlock.Difficulty
-	}
-}
-
-func GenerateRawBlock(data []tx.Transaction) *Block {
-	previousBlock := GetLatestBlock()
-	difficulty := getDifficulty(blockchain)
-	nextIndex := previousBlock.Index + 1
-	nextTimestamp := time.Now().Unix()
-	newBlock := FindBlock(nextIndex, previousBlock.Hash, nextTimestamp, data, difficulty)
-
-	if AddBlockToChain(newBlock) {
-		return &newBlock
-	} else {
-		return nil
-	}
+// GenerateRawBlock mines a block with data on the current tip. The data is
+// built for that tip, so mining stops when another block arrives first.
+func GenerateRawBlock(data []tx.Transaction) (*Block, error) {
+	return mineOnTip(context.Background(), func(previousBlock Block) []tx.Transaction {
+		return data
+	})
 }
 
 func GetMyUnspentTransactionOutputs() tx.UnspentTxOuts {
@@ -129,12 +190,47 @@ func GenerateNextBlock() *Block {
 		panic(err)
 	}
 
-	coinbaseTx := tx.GetCoinbaseTransaction(address, GetLatestBlock().Index+1)
-	var blockData = []tx.Transaction{coinbaseTx}
-	txPool := tx.GetTransactionPool()
-	blockData = append(blockData, txPool...)
+	return generateNextBlockTo(address)
+}
+
+func generateNextBlockTo(address string) *Block {
+	newBlock, err := MineNextBlock(context.Background(), address)
+	if err != nil {
+		log.Printf("could not generate block: %s", err.Error())
+		return nil
+	}
+
+	return newBlock
+}
 
-	return GenerateRawBlock(blockData)
+// MaxGenerateBlocks bounds the blocks a single GenerateBlocks call mines.
+const MaxGenerateBlocks = 1000
+
+// GenerateBlocks mines count blocks paying their coinbase to address, along
+// with the transaction pool. It is only allowed on regtest networks.
+func GenerateBlocks(address string, count int) ([]Block, error) {
+	if !params.Active().RegTest {
+		return nil, errors.Errorf("generating blocks on demand is not allowed on %s", params.Active().Name)
+	}
+
+	if count < 1 || count > MaxGenerateBlocks {
+		return nil, errors.Errorf("count must be between 1 and %d", MaxGenerateBlocks)
+	}
+
+	if !tx.IsValidAddress(address) {
+		return nil, errors.New("Invalid address")
+	}
+
+	blocks := make([]Block, 0, count)
+	for i := 0; i < count; i++ {
+		newBlock := generateNextBlockTo(address)
+		if newBlock == nil {
+			return blocks, errors.Errorf("could not generate block %d of %d", i+1, count)
+		}
+		blocks = append(blocks, *newBlock)
+	}
+
+	return blocks, nil
 }
 
 func GenerateNextBlockWithTransation(receiverAddress string, amount int64) (*Block, error) {
@@ -148,149 +244,131 @@ func GenerateNextBlockWithTransation(receiverAddress string, amount int64) (*Blo
 		return nil, err
 	}
 
-	transaction, err := wallet.CreateTransaction(receiverAddress, amount, privateKey, GetUnpentTxOuts(), tx.GetTransactionPool())
+	transaction, err := wallet.CreateTransaction(receiverAddress, amount, 0, privateKey, GetUnpentTxOuts(), tx.GetTransactionPool(), GetLatestBlock().Index+1)
 	if err != nil {
 		return nil, err
 	}
 
 	blockData := []tx.Transaction{coinbaseTx, *transaction}
 
-	return GenerateRawBlock(blockData), nil
+	return GenerateRawBlock(blockData)
 }
 
-func FindBlock(index int64, previousHash string, timestamp int64, data []tx.Transaction, difficulty int) Block {
-	var nonce int64 = 0
-	for {
-		hash := calculateHash(index, previousHash, timestamp, data, difficulty, nonce)
-		if HasMatchesDifficulty(hash, difficulty) {
-			return NewBlock(index, hash, previousHash, timestamp, data, difficulty, nonce)
-		}
-		nonce++
-	}
+// FindBlock searches the nonces one by one on a single goroutine, see
+// FindBlockContext for mining on several.
+func FindBlock(index int64, previousHash string, timestamp int64, data []tx.Transaction, bits uint32) Block {
+	block, _ := FindBlockContext(context.Background(), index, previousHash, timestamp, data, bits, 1)
+	return block
 }
 
-func GetAccountBalance() (int64, error) {
+// GetAccountBalance returns the spendable and the immature balance of the
+// wallet.
+func GetAccountBalance() (int64, int64, error) {
 	publicKey, err := wallet.GetPublicFromWallet()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	return wallet.GetBalance(publicKey, GetUnpentTxOuts()), nil
+	spendable, immature := wallet.GetBalance(publicKey, GetUnpentTxOuts(), GetLatestBlock().Index+1)
+	return spendable, immature, nil
 }
 
-func SendTransaction(address string, amount int64) (*tx.Transaction, error) {
+func SendTransaction(address string, amount int64, fee int64) (*tx.Transaction, error) {
 	privateKey, err := wallet.GetPrivateFromWallet()
 	if err != nil {
 		return nil, err
 	}
 
-	transaction, err := wallet.CreateTransaction(address, amount, privateKey, GetUnpentTxOuts(), tx.GetTransactionPool())
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	transaction, err := wallet.CreateTransaction(address, amount, fee, privateKey, GetUnpentTxOuts(), tx.GetTransactionPool(), GetLatestBlock().Index+1)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = tx.AddToTransactionPool(transaction, GetUnpentTxOuts())
+	_, err = tx.AddToTransactionPool(transaction, GetUnpentTxOuts(), GetLatestBlock().Index+1, tipMedianTime())
 	if err != nil {
-		log.Print(err.Error())
+		return nil, err
 	}
 
 	return transaction, nil
 }
 
-func HasMatchesDifficulty(hash string, difficulty int) bool {
-	hexStr := HexToBin(hash)
-	difficultyPrefix := strings.Repeat("0", difficulty)
-	matched := strings.HasPrefix(hexStr, difficultyPrefix)
-	return matched
+// SignTransaction signs the inputs of transaction that spend outputs of
+// the wallet, see wallet.SignTransaction.
+func SignTransaction(transaction *tx.Transaction, hashType tx.SigHashType) (int, error) {
+	privateKey, err := wallet.GetPrivateFromWallet()
+	if err != nil {
+		return 0, err
+	}
+
+	return wallet.SignTransaction(transaction, privateKey, GetUnpentTxOuts(), hashType)
+}
+
+// CreateMultisigSpend builds the unsigned transaction spending outputs of
+// multisigAddress, see wallet.CreateMultisigSpend.
+func CreateMultisigSpend(multisigAddress string, address string, amount int64, fee int64) (*tx.Transaction, error) {
+	return wallet.CreateMultisigSpend(multisigAddress, address, amount, fee, GetUnpentTxOuts(), tx.GetTransactionPool(), GetLatestBlock().Index+1)
 }
 
-func HexToBin(s string) (binString string) {
-	characters := strings.Split(s, "")
-	for _, c := range characters {
-		i, _ := strconv.ParseUint(c, 16, 4)
-		binString = fmt.Sprintf("%s%04b", binString, i)
+// CosignTransaction adds the signature of the wallet to the multisig inputs
+// of transaction, see wallet.CosignTransaction.
+func CosignTransaction(transaction *tx.Transaction, hashType tx.SigHashType) (int, error) {
+	privateKey, err := wallet.GetPrivateFromWallet()
+	if err != nil {
+		return 0, err
 	}
-	return
+
+	return wallet.CosignTransaction(transaction, privateKey, GetUnpentTxOuts(), hashType)
 }
 
-func calculateHash(index int64, previousHash string, timestamp int64, data []tx.Transaction, difficulty int, nonce int64) string {
-	idString := From(data).Select(func(i interface{}) interface{} {
-		tx := i.(tx.Transaction)
-		return tx.Id
-	}).OrderBy(func(i interface{}) interface{} {
-		str := i.(string)
-		return str
-	}).AggregateWithSeed("", func(i interface{}, i2 interface{}) interface{} {
-		str1 := i.(string)
-		str2 := i2.(string)
-		return str1 + str2
-	}).(string)
+// FinalizeTransaction completes the multisig inputs of transaction, see
+// wallet.FinalizeTransaction.
+func FinalizeTransaction(transaction *tx.Transaction) error {
+	return wallet.FinalizeTransaction(transaction, GetUnpentTxOuts())
+}
 
-	hashStr := fmt.Sprintf("%d%s%d%s%d%d", index, previousHash, timestamp, idString, difficulty, nonce)
-	bytes := sha256.Sum256([]byte(hashStr))
-	return fmt.Sprintf("%x", bytes)
+func calculateHash(index int64, previousHash string, timestamp int64, merkleRoot string, bits uint32, nonce int64) string {
+	header := BlockHeader{Index: index, PreviousHash: previousHash, Timestamp: timestamp, MerkleRoot: merkleRoot, Bits: bits, Nonce: nonce}
+	return header.Hash()
 }
 
-func AddBlockToChain(newBlock Block) bool {
-	if isValidNewBlock(newBlock, GetLatestBlock()) {
-		retVal, err := tx.ProcessTransactions(newBlock.Data, GetUnpentTxOuts(), newBlock.Index)
-		if err != nil {
-			return false
-		} else {
-			blockchain = append(blockchain, newBlock)
-			SetUnpentTxOuts(retVal)
-			tx.UpdateTransactionPool(retVal)
-			return true
-		}
-	}
+// AddBlockToChain adds a block to the block tree, see processBlock. The
+// error tells why it was rejected.
+func AddBlockToChain(newBlock Block) error {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
 
-	return false
+	return processBlock(newBlock)
 }
 
-func isValidNewBlock(newBlock Block, previousBlock Block) bool {
+func isValidNewBlock(newBlock Block, previousBlock Block, medianTime int64) error {
 	if previousBlock.Index+1 != newBlock.Index {
-		fmt.Errorf("invalid Index")
-		return false
+		return errors.Wrapf(ErrBadIndex, "block %s at index %d on parent at index %d", newBlock.Hash, newBlock.Index, previousBlock.Index)
 	} else if previousBlock.Hash != newBlock.PreviousHash {
-		fmt.Errorf("invalid previous Hash")
-		return false
-	} else if newBlock.calculateHashForBlock() != newBlock.Hash {
-		fmt.Errorf("invalid Hash")
-		return false
-	} else if !isValidTimestamp(newBlock, previousBlock) {
-		fmt.Errorf("invalid timestamp")
-		return false
-	} else if !hasValidHash(newBlock) {
-		return false
-	}
-
-	return true
-}
-
-func getAccumulatedDifficulty(aBlockchain []Block) float64 {
-	return From(aBlockchain).Select(func(i interface{}) interface{} {
-		block := i.(Block)
-		value := math.Pow(2, float64(block.Difficulty))
-		return value
-	}).AggregateWithSeed(float64(0), func(i interface{}, j interface{}) interface{} {
-		nI := i.(float64)
-		nJ := j.(float64)
-		return nI + nJ
-	}).(float64)
-}
-
-func hasValidHash(block Block) bool {
+		return errors.Wrapf(ErrBadPrevHash, "block %s on parent %s", newBlock.Hash, previousBlock.Hash)
+	} else if hasDuplicateTxIds(newBlock.Data) {
+		return errors.Wrapf(ErrDuplicateTx, "block %s", newBlock.Hash)
+	} else if CalculateMerkleRoot(newBlock.Data) != newBlock.MerkleRoot {
+		return errors.Wrapf(ErrBadMerkleRoot, "block %s", newBlock.Hash)
+	} else if err := isValidTimestamp(newBlock, medianTime); err != nil {
+		return err
+	}
+
+	return hasValidHash(newBlock)
+}
+
+func hasValidHash(block Block) error {
 	if !hasMatchesBlockContent(block) {
-		log.Printf("invalid hash, got %s", block.Hash)
-		return false
+		return errors.Wrapf(ErrBadHash, "block %s", block.Hash)
 	}
 
-	if !HasMatchesDifficulty(block.Hash, block.Difficulty) {
-		log.Printf("block difficulty not satisfied. Expected: %d got: %s", block.Difficulty, block.Hash)
-		return false
+	if !HasMatchesTarget(block.Hash, block.Bits) {
+		return errors.Wrapf(ErrTargetNotMet, "block %s at bits %08x", block.Hash, block.Bits)
 	}
 
-	return true
+	return nil
 }
 
 func hasMatchesBlockContent(block Block) bool {
@@ -298,60 +376,149 @@ func hasMatchesBlockContent(block Block) bool {
 	return blockHash == block.Hash
 }
 
-func isValidTimestamp(newBlock Block, previousBlock Block) bool {
-	currentTimestamp := time.Now().Unix()
-	const gap int64 = 60
-	return (previousBlock.Timestamp-gap) < newBlock.Timestamp && (newBlock.Timestamp-gap) < currentTimestamp;
+// medianTimeBlocks is how many of the latest blocks the median time past
+// is taken over.
+const medianTimeBlocks = 11
+
+// isValidTimestamp requires a block to be timestamped after the median time
+// past of its parent and not too far ahead of the network-adjusted time.
+func isValidTimestamp(newBlock Block, medianTime int64) error {
+	if newBlock.Timestamp <= medianTime {
+		return errors.Wrapf(ErrBadTimestamp, "block %s is timestamped %d, not after the median time past %d", newBlock.Hash, newBlock.Timestamp, medianTime)
+	}
+
+	maxTimestamp := AdjustedNow().Unix() + params.Active().MaxFutureBlockTime
+	if newBlock.Timestamp > maxTimestamp {
+		return errors.Wrapf(ErrBadTimestamp, "block %s is timestamped %d, too far in the future", newBlock.Hash, newBlock.Timestamp)
+	}
+
+	return nil
+}
+
+// medianTimePast returns the median timestamp of the last medianTimeBlocks
+// of ancestors, which are ordered by height, or 0 without any.
+func medianTimePast(ancestors []BlockHeader) int64 {
+	if len(ancestors) == 0 {
+		return 0
+	}
+
+	if len(ancestors) > medianTimeBlocks {
+		ancestors = ancestors[len(ancestors)-medianTimeBlocks:]
+	}
+
+	timestamps := make([]int64, 0, len(ancestors))
+	for _, header := range ancestors {
+		timestamps = append(timestamps, header.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
+// nextTimestamp returns the timestamp of a block mined on parent now, at
+// least one second after the median time past.
+func nextTimestamp(parent *blockNode) int64 {
+	timestamp := AdjustedNow().Unix()
+	if medianTime := medianTimePast(ancestorHeaders(parent, medianTimeBlocks)); timestamp <= medianTime {
+		timestamp = medianTime + 1
+	}
+	return timestamp
+}
+
+// GetMedianTimePast returns the median time past of the tip, the next block
+// must be timestamped after it.
+func GetMedianTimePast() int64 {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	return tipMedianTime()
+}
+
+// tipMedianTime is GetMedianTimePast for callers holding chainMutex.
+func tipMedianTime() int64 {
+	return medianTimePast(ancestorHeaders(tree.tip, medianTimeBlocks))
 }
 
-func isValidChain(blockchainToValidate []Block) tx.UnspentTxOuts {
+// isValidChain validates a whole chain from the genesis block and returns
+// the unspent transaction outputs at its tip.
+func isValidChain(blockchainToValidate []Block) (tx.UnspentTxOuts, error) {
 	toValidateBytes, err := json.Marshal(blockchainToValidate[0])
 	if err != nil {
-		log.Printf("can't marshal %v", blockchainToValidate[0])
-		return nil
+		return nil, errors.Wrap(err, "isValidChain-Marshal")
 	}
 
 	basedBytes, _ := json.Marshal(genesisBlock)
 	if bytes.Compare(toValidateBytes, basedBytes) != 0 {
-		return nil
+		return nil, errors.Wrapf(ErrBadGenesis, "block %s", blockchainToValidate[0].Hash)
 	}
 
 	var aUnspentTxOuts tx.UnspentTxOuts
+	var headers []BlockHeader
 
 	for i := 0; i < len(blockchainToValidate); i++ {
 		currentBlock := blockchainToValidate[i]
-		if i != 0 && !isValidNewBlock(blockchainToValidate[i], blockchainToValidate[i-1]) {
-			return nil
+		medianTime := medianTimePast(headers)
+		if i != 0 {
+			if err := isValidNewBlock(currentBlock, blockchainToValidate[i-1], medianTime); err != nil {
+				return nil, err
+			}
+
+			if expected := expectedBits(headers); currentBlock.Bits != expected {
+				return nil, errors.Wrapf(ErrBadBits, "block %s has bits %08x, expected %08x", currentBlock.Hash, currentBlock.Bits, expected)
+			}
 		}
+		headers = append(headers, currentBlock.Header())
 
-		aUnspentTxOuts, err = tx.ProcessTransactions(currentBlock.Data, aUnspentTxOuts, currentBlock.Index)
+		aUnspentTxOuts, err = tx.ProcessTransactions(currentBlock.Data, aUnspentTxOuts, currentBlock.Index, medianTime)
 		if err != nil {
-			log.Printf("Invalid transactions")
-			return nil
+			return nil, errors.Wrapf(err, "block %s", currentBlock.Hash)
 		}
 	}
 
-	return aUnspentTxOuts
+	return aUnspentTxOuts, nil
 }
 
-func ReplaceChain(newBlocks []Block) {
-	aUnspentTxOuts := isValidChain(newBlocks)
-	validChain := aUnspentTxOuts != nil
+// ReplaceChain adds the blocks of a chain received from a peer to the block
+// tree. The node switches to it once it has more work than the main chain.
+// It stops at the first invalid block and returns why it was rejected.
+func ReplaceChain(newBlocks []Block) error {
+	if len(newBlocks) == 0 || newBlocks[0].Hash != genesisBlock.Hash {
+		return errors.Wrap(ErrBadGenesis, "received blockchain")
+	}
 
-	if validChain && getAccumulatedDifficulty(newBlocks) > getAccumulatedDifficulty(GetBlockchain()) {
-		log.Printf("Received blockchain is valid. Replacing current blockchain with received blockchain")
-		blockchain = newBlocks
-		SetUnpentTxOuts(aUnspentTxOuts)
-		tx.UpdateTransactionPool(unspentTxOuts)
-	} else {
-		log.Printf("Received blockchain invalid")
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	oldTip := tree.tip
+	defer func() {
+		if tree.tip != oldTip {
+			log.Printf("Received blockchain has more work. Main chain now ends at %s", tree.tip.block.Hash)
+		}
+	}()
+
+	for _, newBlock := range newBlocks[1:] {
+		if _, known := tree.get(newBlock.Hash); known {
+			continue
+		}
+
+		if err := processBlock(newBlock); err != nil {
+			return errors.Wrap(err, "received blockchain")
+		}
 	}
+
+	return nil
 }
 
-func HandleReceivedTransaction(transaction *tx.Transaction) {
-	tx.AddToTransactionPool(transaction, GetUnpentTxOuts())
+// HandleReceivedTransaction adds a transaction relayed by a peer to the
+// transaction pool.
+func HandleReceivedTransaction(transaction *tx.Transaction) error {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	_, err := tx.AddToTransactionPool(transaction, GetUnpentTxOuts(), GetLatestBlock().Index+1, tipMedianTime())
+	return err
 }
 
 func (block *Block) calculateHashForBlock() string {
-	return calculateHash(block.Index, block.PreviousHash, block.Timestamp, block.Data, block.Difficulty, block.Nonce)
+	return calculateHash(block.Index, block.PreviousHash, block.Timestamp, block.MerkleRoot, block.Bits, block.Nonce)
 }
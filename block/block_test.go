@@ -5,7 +5,9 @@ import (
 	"testing"
 	"github.com/go-naivecoin/block"
 	"github.com/go-naivecoin/tx"
+	"github.com/go-naivecoin/params"
 	"fmt"
+	"math/big"
 )
 
 const (
@@ -16,29 +18,61 @@ const (
 func TestNewBlock_IfHashIsEmpty_ThenCalculate(t *testing.T)  {
 	newBlock := block.NewBlock(1, "", "91a73664bc84c0baa1fc75ea6e4aa6d1d20c5df664c724e3159aefc2e1186627",1465154715,nil, 0, 0)
 
-	assert.Equal(t,"a5d76fec271299ff42eb51d3666f102c34ab9fc86ebb1dbb3edb64a393b1435b", newBlock.Hash)
+	assert.Equal(t,"6454bec8408724facbebfa52e587c04c28d911051180d5735e5ad7089081fa6a", newBlock.Hash)
 }
 
-func TestHasMatchesDifficulty(t *testing.T) {
-	matched := block.HasMatchesDifficulty("0123456789abcdef", 7)
+func TestFindBlock(t *testing.T) {
+	newBlock := block.FindBlock(1,"9cbfae34f219c6c217ea85a24e94b912a7ec1dc894248bab67fcb27497533a7e",1465154725, nil, block.DifficultyToBits(6))
 
-	assert.True(t, matched)
+	assert.Equal(t,int64(49),  newBlock.Nonce)
 }
 
-func TestHexToBin(t *testing.T)  {
-	str := block.HexToBin("0123456789abcdef")
+func TestCompactToBig_ThenBigToCompact(t *testing.T) {
+	target := block.CompactToBig(0x1d00ffff)
 
-	assert.Equal(t, "0000000100100011010001010110011110001001101010111100110111101111",str)
+	assert.Equal(t, "ffff0000000000000000000000000000000000000000000000000000", target.Text(16))
+	assert.Equal(t, uint32(0x1d00ffff), block.BigToCompact(target))
+	// a mantissa with its high bit set would be negative
+	assert.Equal(t, uint32(0x21008000), block.BigToCompact(new(big.Int).Lsh(big.NewInt(0x80), 8*31)))
+	assert.Equal(t, uint32(0x207fffff), block.DifficultyToBits(1))
 }
 
-func TestFindBlock(t *testing.T) {
-	newBlock := block.FindBlock(1,"9cbfae34f219c6c217ea85a24e94b912a7ec1dc894248bab67fcb27497533a7e",1465154725, nil, 6)
+func TestHasMatchesTarget(t *testing.T) {
+	bits := block.DifficultyToBits(6)
+
+	assert.True(t, block.HasMatchesTarget("03fffe0000000000000000000000000000000000000000000000000000000000", bits))
+	assert.False(t, block.HasMatchesTarget("0400000000000000000000000000000000000000000000000000000000000000", bits))
+	assert.False(t, block.HasMatchesTarget("not hex", bits))
+}
 
-	assert.Equal(t,int64(24),  newBlock.Nonce)
+func TestCalcWork(t *testing.T) {
+	assert.Equal(t, int64(256), block.CalcWork(block.DifficultyToBits(8)).Int64())
+	assert.Equal(t, int64(2), block.CalcWork(0x207fffff).Int64())
+	assert.Equal(t, int64(0), block.CalcWork(0).Int64())
+}
+
+func TestBlock_MarshalBinary_ThenUnmarshalBinary(t *testing.T) {
+	data := []tx.Transaction{tx.GetCoinbaseTransaction(ADDRESS, 1)}
+	newBlock := block.FindBlock(1, "9cbfae34f219c6c217ea85a24e94b912a7ec1dc894248bab67fcb27497533a7e", 1465154725, data, block.DifficultyToBits(4))
+
+	encoded, err := newBlock.MarshalBinary()
+	assert.Nil(t, err)
+
+	var decoded block.Block
+	assert.Nil(t, decoded.UnmarshalBinary(encoded))
+	assert.Equal(t, newBlock, decoded)
+
+	header, err := newBlock.Header().MarshalBinary()
+	assert.Nil(t, err)
+	var decodedHeader block.BlockHeader
+	assert.Nil(t, decodedHeader.UnmarshalBinary(header))
+	assert.Equal(t, newBlock.Hash, decodedHeader.Hash())
+
+	assert.NotNil(t, decoded.UnmarshalBinary(encoded[:len(encoded)-1]))
 }
 
 func TestSetUnpentTxOuts_TheGetUnpentTxOuts(t *testing.T) {
-	var utxos tx.UnspentTxOuts = tx.UnspentTxOuts{tx.UnspentTxOut{"1", 1, ADDRESS, 1}}
+	var utxos tx.UnspentTxOuts = tx.UnspentTxOuts{tx.UnspentTxOut{TxOutId: "1", TxOutIndex: 1, Address: ADDRESS, Amount: 1}}
 
 	block.SetUnpentTxOuts(utxos)
 
@@ -50,3 +84,97 @@ func TestSetUnpentTxOuts_TheGetUnpentTxOuts(t *testing.T) {
 	assert.NotEqual(t, oldAddress, newAddress)
 
 }
+
+func TestGetBlockByHash_ThenGetTransactionLocation(t *testing.T) {
+	genesis, found := block.GetBlockByHeight(0)
+	assert.True(t, found)
+
+	byHash, found := block.GetBlockByHash(genesis.Hash)
+	assert.True(t, found)
+	assert.Equal(t, genesis.Hash, byHash.Hash)
+
+	location, found := block.GetTransactionLocation(genesis.Data[0].Id)
+	assert.True(t, found)
+	assert.Equal(t, block.TransactionLocation{BlockIndex: 0, BlockHash: genesis.Hash, Position: 0}, location)
+
+	_, found = block.GetBlockByHash("unknown")
+	assert.False(t, found)
+}
+
+func TestEnableAddressIndex_ThenGetAddressHistory(t *testing.T) {
+	block.EnableAddressIndex()
+
+	genesis, _ := block.GetBlockByHeight(0)
+	genesisTx := genesis.Data[0]
+
+	txOuts, total := block.GetAddressHistory(genesisTx.TxOuts[0].Address, 0, 10)
+
+	assert.Equal(t, 1, total)
+	assert.Equal(t, genesisTx.Id, txOuts[0].TxOutId)
+	assert.Nil(t, txOuts[0].SpentBy)
+
+	txOuts, total = block.GetAddressHistory(genesisTx.TxOuts[0].Address, 1, 10)
+	assert.Equal(t, 1, total)
+	assert.Empty(t, txOuts)
+}
+
+func TestGetMerkleProof_ThenVerifyMerkleProof(t *testing.T) {
+	transactions := []tx.Transaction{
+		tx.GetCoinbaseTransaction(ADDRESS, 1),
+		tx.GetCoinbaseTransaction(ADDRESS, 2),
+		tx.GetCoinbaseTransaction(ADDRESS, 3),
+	}
+	merkleRoot := block.CalculateMerkleRoot(transactions)
+
+	for _, transaction := range transactions {
+		proof, found := block.GetMerkleProof(transactions, transaction.Id)
+		assert.True(t, found)
+		assert.True(t, block.VerifyMerkleProof(proof, merkleRoot))
+	}
+
+	proof, _ := block.GetMerkleProof(transactions, transactions[1].Id)
+	proof.TxId = transactions[0].Id
+	assert.False(t, block.VerifyMerkleProof(proof, merkleRoot))
+
+	// the last transaction pairs with itself, as if it also sat at position 3
+	proof, _ = block.GetMerkleProof(transactions, transactions[2].Id)
+	proof.Position = 3
+	assert.False(t, block.VerifyMerkleProof(proof, merkleRoot))
+	proof.TxCount = 4
+	assert.False(t, block.VerifyMerkleProof(proof, merkleRoot))
+	assert.Equal(t, "", block.CalculateMerkleRoot(nil))
+}
+
+func TestVerifyMerkleProof_EveryPositionOfOddLevels(t *testing.T) {
+	var transactions []tx.Transaction
+	for count := int64(1); count <= 7; count++ {
+		transactions = append(transactions, tx.GetCoinbaseTransaction(ADDRESS, count))
+		merkleRoot := block.CalculateMerkleRoot(transactions)
+
+		for _, transaction := range transactions {
+			proof, found := block.GetMerkleProof(transactions, transaction.Id)
+			assert.True(t, found)
+			assert.True(t, block.VerifyMerkleProof(proof, merkleRoot))
+		}
+
+		// the last transaction claimed again right after itself
+		proof, _ := block.GetMerkleProof(transactions, transactions[count-1].Id)
+		proof.Position++
+		proof.TxCount++
+		assert.False(t, block.VerifyMerkleProof(proof, merkleRoot))
+	}
+}
+
+func TestInitBlockStore_GenesisHashPinned(t *testing.T) {
+	defer block.InitBlockStore("")
+	defer params.SetActive(&params.MainNetParams)
+
+	assert.Nil(t, block.InitBlockStore(""))
+	genesis, _ := block.GetBlockByHeight(0)
+	assert.Equal(t, params.MainNetParams.GenesisHash, genesis.Hash)
+
+	chainParams := params.MainNetParams
+	chainParams.GenesisNonce++
+	params.SetActive(&chainParams)
+	assert.NotNil(t, block.InitBlockStore(""))
+}
@@ -0,0 +1,305 @@
+package block
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+)
+
+// chainMutex serialises every change to the block tree, the main chain and
+// the unspent transaction outputs.
+var chainMutex sync.Mutex
+
+var tree = newBlockTree([]Block{genesisBlock})
+
+var undoStore UndoStore = NewMemoryUndoStore()
+
+// maxRejectedBlocks bounds how many dropped block copies are remembered.
+const maxRejectedBlocks = 1000
+
+// rejectedBlocks holds the copies of blocks dropped from the block tree, by
+// rejectedKey, so that a peer resending the same broken copy does not get it
+// validated again. rejectedOrder evicts the oldest first.
+var rejectedBlocks = make(map[string]bool)
+var rejectedOrder []string
+
+// rejectedKey identifies a copy of a block: its hash along with a digest of
+// its whole body, signatures included, which the hash does not commit to.
+func rejectedKey(block Block) string {
+	data, _ := block.MarshalBinary()
+	return fmt.Sprintf("%s:%x", block.Hash, sha256.Sum256(data))
+}
+
+func rememberRejected(block Block) {
+	key := rejectedKey(block)
+	if rejectedBlocks[key] {
+		return
+	}
+
+	if len(rejectedOrder) >= maxRejectedBlocks {
+		delete(rejectedBlocks, rejectedOrder[0])
+		rejectedOrder = rejectedOrder[1:]
+	}
+	rejectedBlocks[key] = true
+	rejectedOrder = append(rejectedOrder, key)
+}
+
+func resetRejected() {
+	rejectedBlocks = make(map[string]bool)
+	rejectedOrder = nil
+}
+
+// processBlock adds newBlock to the block tree. It is connected right away
+// when it extends the main chain, triggers a reorganisation when its branch
+// gets more work than the main chain, and is kept aside otherwise.
+func processBlock(newBlock Block) error {
+	if _, known := tree.get(newBlock.Hash); known {
+		return errors.Wrapf(ErrKnownBlock, "block %s", newBlock.Hash)
+	}
+
+	if rejectedBlocks[rejectedKey(newBlock)] {
+		return errors.Wrapf(ErrRejectedBlock, "block %s", newBlock.Hash)
+	}
+
+	parent, found := tree.get(newBlock.PreviousHash)
+	if !found {
+		return errors.Wrapf(ErrOrphanBlock, "parent %s of block %s", newBlock.PreviousHash, newBlock.Hash)
+	}
+
+	if parent.isInvalid() {
+		return errors.Wrapf(ErrInvalidBranch, "block %s", newBlock.Hash)
+	}
+
+	if err := isValidNewBlock(newBlock, parent.block, medianTimePast(ancestorHeaders(parent, medianTimeBlocks))); err != nil {
+		return err
+	}
+
+	if expected := nextBits(parent); newBlock.Bits != expected {
+		return errors.Wrapf(ErrBadBits, "block %s has bits %08x, expected %08x", newBlock.Hash, newBlock.Bits, expected)
+	}
+
+	node := tree.add(newBlock, parent)
+
+	if parent == tree.tip {
+		if err := connectBlock(node); err != nil {
+			discardFailedBlock(node, err)
+			return err
+		}
+		return nil
+	}
+
+	if node.work.Cmp(tree.tip.work) > 0 {
+		log.Printf("branch ending at block %s has more work than the main chain, reorganising", newBlock.Hash)
+		return reorganize(node)
+	}
+
+	log.Printf("block %s at index %d extends a side branch", newBlock.Hash, newBlock.Index)
+	return nil
+}
+
+// invalidatesBlock tells whether err, returned by connectBlock, proves the
+// block invalid. The block hash commits to the transaction ids, which leave
+// out the signatures and unlocking scripts, so a relayed copy may carry a
+// broken body under the hash of a valid block. Storage errors prove nothing
+// either.
+func invalidatesBlock(err error) bool {
+	switch errors.Cause(err) {
+	case tx.ErrMissingTxOut, tx.ErrImmatureCoinbase, tx.ErrNegativeAmount, tx.ErrAmountOutOfRange, tx.ErrInputsOutputsMismatch, tx.ErrDoubleSpend, tx.ErrBadCoinbase:
+		return true
+	}
+	return false
+}
+
+// discardFailedBlock marks node invalid when err proves it so, and otherwise
+// drops it from the block tree so that another copy of it can still arrive.
+// The dropped copy itself is remembered as rejected.
+func discardFailedBlock(node *blockNode, err error) {
+	if invalidatesBlock(err) {
+		node.invalid = true
+		return
+	}
+
+	log.Printf("dropping block %s from the block tree, another copy of it may still connect: %s", node.block.Hash, err.Error())
+	tree.remove(node)
+	rememberRejected(node.block)
+}
+
+// connectBlock applies the transactions of node, a child of the current tip,
+// records what they spent as undo data and makes node the new tip.
+func connectBlock(node *blockNode) error {
+	aUnspentTxOuts := GetUnpentTxOuts()
+	medianTime := medianTimePast(ancestorHeaders(node.parent, medianTimeBlocks))
+	retVal, err := tx.ProcessTransactions(node.block.Data, aUnspentTxOuts, node.block.Index, medianTime)
+	if err != nil {
+		return errors.Wrapf(err, "block %s", node.block.Hash)
+	}
+
+	undo := BlockUndo{BlockHash: node.block.Hash, SpentTxOuts: tx.GetSpentTxOuts(node.block.Data, aUnspentTxOuts)}
+	if err := undoStore.Put(undo); err != nil {
+		return errors.Wrapf(err, "could not store undo data of block %s", node.block.Hash)
+	}
+
+	if err := store.Append(node.block); err != nil {
+		return errors.Wrapf(err, "could not store block %s", node.block.Hash)
+	}
+
+	node.validated = true
+	tree.tip = node
+	indexBlock(node.block)
+	SetUnpentTxOuts(retVal)
+	tx.UpdateTransactionPool(retVal, node.block.Index+1, tipMedianTime())
+	notifyTipChanged()
+	return nil
+}
+
+// disconnectTip removes the tip from the main chain using its undo data and
+// puts its transactions back into the transaction pool.
+func disconnectTip() (Block, error) {
+	tip := tree.tip
+	if tip.parent == nil {
+		return Block{}, errors.New("cannot disconnect the genesis block")
+	}
+
+	undo, found := undoStore.Get(tip.block.Hash)
+	if !found {
+		return Block{}, errors.Errorf("no undo data for block %s", tip.block.Hash)
+	}
+
+	if err := store.Truncate(store.Len() - 1); err != nil {
+		return Block{}, errors.Wrap(err, "disconnectTip-Truncate")
+	}
+
+	aUnspentTxOuts := tx.RevertTransactions(tip.block.Data, GetUnpentTxOuts(), undo.SpentTxOuts)
+
+	tree.tip = tip.parent
+	unindexBlock(tip.block)
+	SetUnpentTxOuts(aUnspentTxOuts)
+	undoStore.Delete(tip.block.Hash)
+	tx.UpdateTransactionPool(aUnspentTxOuts, tip.block.Index, tipMedianTime())
+	tx.ReturnToTransactionPool(tip.block.Data[1:], aUnspentTxOuts, tip.block.Index, tipMedianTime())
+	notifyTipChanged()
+
+	log.Printf("disconnected block %s at index %d", tip.block.Hash, tip.block.Index)
+	return tip.block, nil
+}
+
+// disconnectTo rolls the main chain back until fork is its tip. Blocks
+// without undo data, stored before it was recorded, are rolled back by
+// replaying the remaining chain instead.
+func disconnectTo(fork *blockNode) bool {
+	for tree.tip != fork {
+		if _, err := disconnectTip(); err != nil {
+			log.Printf("%s, replaying the blockchain up to block %s", err.Error(), fork.block.Hash)
+			return replayTo(fork)
+		}
+	}
+
+	return true
+}
+
+func replayTo(fork *blockNode) bool {
+	blocks := store.Blocks()[:fork.block.Index+1]
+
+	aUnspentTxOuts, err := isValidChain(blocks)
+	if err != nil {
+		log.Printf("could not replay the blockchain up to block %s: %s", fork.block.Hash, err.Error())
+		return false
+	}
+
+	if err := store.Truncate(len(blocks)); err != nil {
+		log.Printf("could not truncate the stored blockchain: %s", err.Error())
+		return false
+	}
+
+	tree.tip = fork
+	reindexChain(blocks)
+	SetUnpentTxOuts(aUnspentTxOuts)
+	notifyTipChanged()
+	return true
+}
+
+// DisconnectBlock removes the tip from the main chain, restoring the
+// unspent transaction outputs it spent, and returns it. Its transactions go
+// back into the transaction pool.
+func DisconnectBlock() (*Block, error) {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	block, err := disconnectTip()
+	if err != nil {
+		return nil, err
+	}
+
+	return &block, nil
+}
+
+// reorganize switches the main chain to the branch ending at newTip. If a
+// block of that branch turns out to be invalid the old chain is restored.
+func reorganize(newTip *blockNode) error {
+	oldTip := tree.tip
+	fork := tree.findFork(oldTip, newTip)
+
+	log.Printf("reorganising from %s to %s, fork at index %d", oldTip.block.Hash, newTip.block.Hash, fork.block.Index)
+
+	if !disconnectTo(fork) {
+		return errors.Errorf("could not roll the main chain back to block %s", fork.block.Hash)
+	}
+
+	for _, node := range tree.branch(fork, newTip) {
+		err := connectBlock(node)
+		if err == nil {
+			continue
+		}
+
+		log.Printf("block %s could not be connected, restoring the chain ending at %s", node.block.Hash, oldTip.block.Hash)
+		discardFailedBlock(node, err)
+
+		if restoreErr := restoreChain(fork, oldTip); restoreErr != nil {
+			log.Printf("could not restore the chain ending at %s, the tip is now %s: %s", oldTip.block.Hash, tree.tip.block.Hash, restoreErr.Error())
+			return errors.Wrapf(restoreErr, "could not restore the chain ending at %s after %s", oldTip.block.Hash, err.Error())
+		}
+		return err
+	}
+
+	tx.UpdateTransactionPool(GetUnpentTxOuts(), newTip.block.Index+1, tipMedianTime())
+	return nil
+}
+
+// restoreChain reconnects the old main chain from fork up to oldTip after a
+// failed reorganisation. On failure the tip stays at the last block that
+// connected again.
+func restoreChain(fork *blockNode, oldTip *blockNode) error {
+	if !disconnectTo(fork) {
+		return errors.Errorf("could not roll the main chain back to block %s", fork.block.Hash)
+	}
+
+	for _, oldNode := range tree.branch(fork, oldTip) {
+		if err := connectBlock(oldNode); err != nil {
+			return errors.Wrap(err, "reconnecting the old chain")
+		}
+	}
+	return nil
+}
+
+// GetChainTips returns the main chain tip and the tip of every side branch
+// the node knows about.
+func GetChainTips() []ChainTip {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	return tree.chainTips()
+}
+
+// HasBlock tells whether the block is part of the block tree, on the main
+// chain or on a side branch.
+func HasBlock(hash string) bool {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	_, found := tree.get(hash)
+	return found
+}
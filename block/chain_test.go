@@ -0,0 +1,287 @@
+package block_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-naivecoin/block"
+	"github.com/go-naivecoin/params"
+	"github.com/go-naivecoin/tx"
+	"github.com/go-naivecoin/wallet"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	OTHER_ADDRESS = "04bfcab8722991ae774db48f934ca79cfb7dd991229153b9f732ba5334aafcd8e7266e47076996b55a14bf9913ee3145ce0cfc1372ada8ada74bd287450313534a"
+	PRIVATE_KEY   = "0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+)
+
+// nextTimestamp returns the current time, or a second after previous when
+// blocks are mined faster, so that timestamps stay after the median time past.
+func nextTimestamp(previous block.Block) int64 {
+	if now := time.Now().Unix(); now > previous.Timestamp {
+		return now
+	}
+	return previous.Timestamp + 1
+}
+
+func mineOn(previous block.Block, address string) block.Block {
+	index := previous.Index + 1
+	data := []tx.Transaction{tx.GetCoinbaseTransaction(address, index)}
+	return block.FindBlock(index, previous.Hash, nextTimestamp(previous), data, previous.Bits)
+}
+
+// useCoinbaseMaturity runs on a fresh mainnet chain whose coinbase outputs
+// mature after maturity blocks, until the returned function restores it.
+func useCoinbaseMaturity(maturity int64) func() {
+	chainParams := params.MainNetParams
+	chainParams.CoinbaseMaturity = maturity
+	params.SetActive(&chainParams)
+	block.InitBlockStore("")
+
+	return func() {
+		params.SetActive(&params.MainNetParams)
+		block.InitBlockStore("")
+	}
+}
+
+func TestAddBlockToChain_SideBranchOvertakes_ThenReorganise(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	genesis := block.GetLatestBlock()
+
+	a1 := mineOn(genesis, ADDRESS)
+	a2 := mineOn(a1, ADDRESS)
+	assert.Nil(t, block.AddBlockToChain(a1))
+	assert.Nil(t, block.AddBlockToChain(a2))
+
+	b1 := mineOn(genesis, OTHER_ADDRESS)
+	assert.Nil(t, block.AddBlockToChain(b1))
+	assert.Equal(t, a2.Hash, block.GetLatestBlock().Hash)
+
+	tips := block.GetChainTips()
+	assert.Len(t, tips, 2)
+	assert.Contains(t, tips, block.ChainTip{Height: 1, Hash: b1.Hash, BranchLen: 1, Status: block.CHAIN_TIP_VALID_HEADERS})
+
+	b2 := mineOn(b1, OTHER_ADDRESS)
+	b3 := mineOn(b2, OTHER_ADDRESS)
+	assert.Nil(t, block.AddBlockToChain(b2))
+	assert.Equal(t, a2.Hash, block.GetLatestBlock().Hash)
+	assert.Nil(t, block.AddBlockToChain(b3))
+	assert.Equal(t, b3.Hash, block.GetLatestBlock().Hash)
+
+	tips = block.GetChainTips()
+	assert.Contains(t, tips, block.ChainTip{Height: 3, Hash: b3.Hash, BranchLen: 0, Status: block.CHAIN_TIP_ACTIVE})
+	assert.Contains(t, tips, block.ChainTip{Height: 2, Hash: a2.Hash, BranchLen: 2, Status: block.CHAIN_TIP_VALID_FORK})
+
+	_, found := block.GetTransactionLocation(a1.Data[0].Id)
+	assert.False(t, found)
+	location, found := block.GetTransactionLocation(b3.Data[0].Id)
+	assert.True(t, found)
+	assert.Equal(t, int64(3), location.BlockIndex)
+
+	for _, utxo := range block.GetUnpentTxOuts() {
+		assert.NotEqual(t, a1.Data[0].Id, utxo.TxOutId)
+		assert.NotEqual(t, a2.Data[0].Id, utxo.TxOutId)
+	}
+}
+
+func TestDisconnectBlock_RestoresUnspentTxOuts(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	genesis := block.GetLatestBlock()
+	utxos := block.GetUnpentTxOuts()
+
+	a1 := mineOn(genesis, ADDRESS)
+	assert.Nil(t, block.AddBlockToChain(a1))
+	assert.NotEqual(t, utxos, block.GetUnpentTxOuts())
+
+	disconnected, err := block.DisconnectBlock()
+	assert.Nil(t, err)
+	assert.Equal(t, a1.Hash, disconnected.Hash)
+	assert.Equal(t, genesis.Hash, block.GetLatestBlock().Hash)
+	assert.Equal(t, utxos, block.GetUnpentTxOuts())
+
+	_, found := block.GetTransactionLocation(a1.Data[0].Id)
+	assert.False(t, found)
+
+	_, err = block.DisconnectBlock()
+	assert.NotNil(t, err)
+}
+
+func TestGenerateBlocks_OnRegTestWithMockTime(t *testing.T) {
+	params.SetActive(&params.RegTestParams)
+	mockTime := time.Unix(1535760100, 0)
+	block.SetClock(func() time.Time {
+		return mockTime
+	})
+	defer func() {
+		params.SetActive(&params.MainNetParams)
+		block.SetClock(nil)
+		block.InitBlockStore("")
+	}()
+	assert.Nil(t, block.InitBlockStore(""))
+
+	blocks, err := block.GenerateBlocks(ADDRESS, 3)
+
+	assert.Nil(t, err)
+	assert.Len(t, blocks, 3)
+	assert.Equal(t, blocks[2].Hash, block.GetLatestBlock().Hash)
+	assert.Equal(t, int64(3), block.GetLatestBlock().Index)
+	assert.Equal(t, mockTime.Unix(), blocks[0].Timestamp)
+	// the clock stands still, later blocks move just past the median time past
+	assert.Equal(t, mockTime.Unix()+1, block.GetLatestBlock().Timestamp)
+	assert.Equal(t, params.RegTestParams.GenesisBits, block.GetLatestBlock().Bits)
+}
+
+func TestGenerateBlocks_CountOutOfRange(t *testing.T) {
+	params.SetActive(&params.RegTestParams)
+	defer func() {
+		params.SetActive(&params.MainNetParams)
+		block.InitBlockStore("")
+	}()
+	assert.Nil(t, block.InitBlockStore(""))
+
+	for _, count := range []int{-1, 0, block.MaxGenerateBlocks + 1} {
+		_, err := block.GenerateBlocks(ADDRESS, count)
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, int64(0), block.GetLatestBlock().Index)
+}
+
+func TestGenerateBlocks_NotOnMainNet(t *testing.T) {
+	_, err := block.GenerateBlocks(ADDRESS, 1)
+
+	assert.NotNil(t, err)
+}
+
+func TestGetSupply_OnRegTest_ThenSubsidyHalves(t *testing.T) {
+	params.SetActive(&params.RegTestParams)
+	defer func() {
+		params.SetActive(&params.MainNetParams)
+		block.InitBlockStore("")
+	}()
+	assert.Nil(t, block.InitBlockStore(""))
+
+	_, err := block.GenerateBlocks(ADDRESS, 150)
+	assert.Nil(t, err)
+
+	supply := block.GetSupply()
+	assert.Equal(t, int64(150), supply.Height)
+	assert.Equal(t, int64(150*50+25), supply.Issued)
+	assert.Equal(t, supply.Issued, supply.ScheduledSupply)
+	assert.Equal(t, int64(25), supply.NextSubsidy)
+	assert.Equal(t, int64(25), block.GetLatestBlock().Data[0].TxOuts[0].Amount)
+	assert.True(t, supply.Capped)
+	assert.Equal(t, supply.MaxSupply-supply.Issued, supply.Remaining)
+}
+
+func TestAddBlockToChain_TimestampAfterMedianTimePast(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	b1 := mineOn(block.GetLatestBlock(), ADDRESS)
+	assert.Nil(t, block.AddBlockToChain(b1))
+	b2 := mineOn(b1, ADDRESS)
+	assert.Nil(t, block.AddBlockToChain(b2))
+	assert.Equal(t, b1.Timestamp, block.GetMedianTimePast())
+
+	mineAt := func(timestamp int64) block.Block {
+		data := []tx.Transaction{tx.GetCoinbaseTransaction(ADDRESS, 3)}
+		return block.FindBlock(3, b2.Hash, timestamp, data, b2.Bits)
+	}
+
+	assert.Equal(t, block.ErrBadTimestamp, errors.Cause(block.AddBlockToChain(mineAt(b1.Timestamp))))
+	assert.Equal(t, block.ErrBadTimestamp, errors.Cause(block.AddBlockToChain(mineAt(time.Now().Unix()+params.Active().MaxFutureBlockTime+60))))
+	// earlier than the parent is fine as long as it is after the median
+	assert.Nil(t, block.AddBlockToChain(mineAt(b1.Timestamp+1)))
+}
+
+func TestCoinbaseMaturity_ImmatureCoinbaseCannotBeSpent(t *testing.T) {
+	defer useCoinbaseMaturity(2)()
+
+	myAddress, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	mined := mineOn(block.GetLatestBlock(), myAddress)
+	assert.Nil(t, block.AddBlockToChain(mined))
+
+	spendable, immature := wallet.GetBalance(myAddress, block.GetUnpentTxOuts(), 2)
+	assert.Equal(t, int64(0), spendable)
+	assert.Equal(t, int64(50), immature)
+	_, err = wallet.CreateTransaction(OTHER_ADDRESS, 10, 0, PRIVATE_KEY, block.GetUnpentTxOuts(), tx.GetTransactionPool(), 2)
+	assert.NotNil(t, err)
+
+	// a block spending it too early is rejected
+	utxos := block.GetUnpentTxOuts()
+	transaction, err := wallet.CreateTransaction(OTHER_ADDRESS, 10, 0, PRIVATE_KEY, utxos, tx.GetTransactionPool(), 3)
+	assert.Nil(t, err)
+	early := block.FindBlock(2, mined.Hash, nextTimestamp(mined), []tx.Transaction{tx.GetCoinbaseTransaction(OTHER_ADDRESS, 2), *transaction}, mined.Bits)
+	assert.Equal(t, tx.ErrImmatureCoinbase, errors.Cause(block.AddBlockToChain(early)))
+
+	assert.Nil(t, block.AddBlockToChain(mineOn(block.GetLatestBlock(), OTHER_ADDRESS)))
+	spendable, immature = wallet.GetBalance(myAddress, block.GetUnpentTxOuts(), 3)
+	assert.Equal(t, int64(50), spendable)
+	assert.Equal(t, int64(0), immature)
+
+	previous := block.GetLatestBlock()
+	spending := block.FindBlock(3, previous.Hash, nextTimestamp(previous), []tx.Transaction{tx.GetCoinbaseTransaction(OTHER_ADDRESS, 3), *transaction}, mined.Bits)
+	assert.Nil(t, block.AddBlockToChain(spending))
+
+	for _, utxo := range block.GetUnpentTxOuts() {
+		if utxo.TxOutId == spending.Data[0].Id {
+			assert.True(t, utxo.IsCoinbase)
+			assert.Equal(t, int64(3), utxo.BlockHeight)
+		}
+	}
+}
+
+func TestAddBlockToChain_BrokenCopyFirst_ThenValidBlockConnects(t *testing.T) {
+	defer useCoinbaseMaturity(1)()
+
+	myAddress, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	mined := mineOn(block.GetLatestBlock(), myAddress)
+	assert.Nil(t, block.AddBlockToChain(mined))
+
+	transaction, err := wallet.CreateTransaction(OTHER_ADDRESS, 10, 0, PRIVATE_KEY, block.GetUnpentTxOuts(), tx.GetTransactionPool(), 2)
+	assert.Nil(t, err)
+	valid := block.FindBlock(2, mined.Hash, nextTimestamp(mined), []tx.Transaction{tx.GetCoinbaseTransaction(OTHER_ADDRESS, 2), *transaction}, mined.Bits)
+
+	// the signature is not part of the transaction id, so the hash still matches
+	broken := valid
+	broken.Data = []tx.Transaction{valid.Data[0], *transaction}
+	broken.Data[1].TxIns = append([]tx.TxIn{}, transaction.TxIns...)
+	broken.Data[1].TxIns[0].Signature = valid.Data[1].TxIns[0].Signature[2:]
+	assert.Equal(t, tx.ErrBadSignature, errors.Cause(block.AddBlockToChain(broken)))
+	assert.Equal(t, mined.Hash, block.GetLatestBlock().Hash)
+
+	// the same broken copy is not validated again
+	assert.Equal(t, block.ErrRejectedBlock, errors.Cause(block.AddBlockToChain(broken)))
+
+	assert.Nil(t, block.AddBlockToChain(valid))
+	assert.Equal(t, valid.Hash, block.GetLatestBlock().Hash)
+}
+
+func TestAddBlockToChain_DuplicateLastTransaction_ThenRejected(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	previous := block.GetLatestBlock()
+	data := []tx.Transaction{
+		tx.GetCoinbaseTransaction(ADDRESS, 1),
+		tx.GetCoinbaseTransaction(ADDRESS, 2),
+		tx.GetCoinbaseTransaction(ADDRESS, 3),
+	}
+	mined := block.FindBlock(1, previous.Hash, nextTimestamp(previous), data, previous.Bits)
+
+	// the merkle root and so the hash stay the same
+	duplicated := mined
+	duplicated.Data = append(append([]tx.Transaction{}, data...), data[2])
+	assert.Equal(t, mined.MerkleRoot, block.CalculateMerkleRoot(duplicated.Data))
+
+	assert.Equal(t, block.ErrDuplicateTx, errors.Cause(block.AddBlockToChain(duplicated)))
+	assert.False(t, block.HasBlock(mined.Hash))
+}
@@ -0,0 +1,29 @@
+package block
+
+import (
+	"sync"
+	"time"
+)
+
+var clockMutex sync.RWMutex
+var clock = time.Now
+
+// SetClock replaces the clock used to timestamp and validate blocks, so that
+// tests can run against a deterministic chain. nil restores the system clock.
+func SetClock(newClock func() time.Time) {
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+
+	if newClock == nil {
+		newClock = time.Now
+	}
+	clock = newClock
+}
+
+// Now returns the current time of the node clock.
+func Now() time.Time {
+	clockMutex.RLock()
+	defer clockMutex.RUnlock()
+
+	return clock()
+}
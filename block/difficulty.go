@@ -0,0 +1,230 @@
+package block
+
+import (
+	"math/big"
+
+	"github.com/go-naivecoin/params"
+)
+
+// DifficultyAlgorithm computes the target a block must meet from the headers
+// of its ancestors.
+type DifficultyAlgorithm interface {
+	// Window is how many of the latest ancestors NextBits looks at, at
+	// least one.
+	Window() int
+	// NextBits returns the target, in compact form, of the block following
+	// the last of ancestors, which are ordered by height and hold at most
+	// Window headers, fewer near the genesis block.
+	NextBits(ancestors []BlockHeader) uint32
+}
+
+// FixedDifficulty keeps every block at the same target.
+type FixedDifficulty struct {
+	Bits uint32
+}
+
+func (algorithm FixedDifficulty) Window() int {
+	return 1
+}
+
+func (algorithm FixedDifficulty) NextBits(ancestors []BlockHeader) uint32 {
+	return algorithm.Bits
+}
+
+// IntervalRetarget scales the target every Interval blocks by the time they
+// took over the expected time, by a factor of four at most.
+type IntervalRetarget struct {
+	Interval      int
+	TargetSpacing int64
+	PowLimitBits  uint32
+}
+
+func (algorithm IntervalRetarget) Window() int {
+	return algorithm.Interval
+}
+
+func (algorithm IntervalRetarget) NextBits(ancestors []BlockHeader) uint32 {
+	latest := ancestors[len(ancestors)-1]
+	if latest.Index == 0 || latest.Index%int64(algorithm.Interval) != 0 || len(ancestors) < algorithm.Interval {
+		return latest.Bits
+	}
+
+	prevAdjustment := ancestors[len(ancestors)-algorithm.Interval]
+	timeExpected := algorithm.TargetSpacing * int64(algorithm.Interval)
+	timeTaken := latest.Timestamp - prevAdjustment.Timestamp
+	if timeTaken < timeExpected/4 {
+		timeTaken = timeExpected / 4
+	} else if timeTaken > timeExpected*4 {
+		timeTaken = timeExpected * 4
+	}
+
+	target := CompactToBig(latest.Bits)
+	target.Mul(target, big.NewInt(timeTaken))
+	target.Div(target, big.NewInt(timeExpected))
+	return limitTarget(target, algorithm.PowLimitBits)
+}
+
+// LWMA retargets every block from the average target of the last WindowSize
+// blocks and their solve times, the recent ones weighing more.
+type LWMA struct {
+	WindowSize    int
+	TargetSpacing int64
+	PowLimitBits  uint32
+}
+
+func (algorithm LWMA) Window() int {
+	// one more header than solve times
+	return algorithm.WindowSize + 1
+}
+
+func (algorithm LWMA) NextBits(ancestors []BlockHeader) uint32 {
+	if len(ancestors) < 2 {
+		return ancestors[len(ancestors)-1].Bits
+	}
+
+	var weightedSolveTimes, weights int64
+	totalTarget := new(big.Int)
+	for i := 1; i < len(ancestors); i++ {
+		// solve times are clamped so that a wrong timestamp cannot move the
+		// target too far
+		solveTime := ancestors[i].Timestamp - ancestors[i-1].Timestamp
+		if solveTime < 1 {
+			solveTime = 1
+		} else if solveTime > 6*algorithm.TargetSpacing {
+			solveTime = 6 * algorithm.TargetSpacing
+		}
+
+		weightedSolveTimes += int64(i) * solveTime
+		weights += int64(i)
+		totalTarget.Add(totalTarget, CompactToBig(ancestors[i].Bits))
+	}
+
+	target := totalTarget.Div(totalTarget, big.NewInt(int64(len(ancestors)-1)))
+	target.Mul(target, big.NewInt(weightedSolveTimes))
+	target.Div(target, big.NewInt(algorithm.TargetSpacing*weights))
+	return limitTarget(target, algorithm.PowLimitBits)
+}
+
+// ASERT sets the target of every block from how far the chain is ahead of
+// or behind its schedule since the anchor, the genesis block, halving or
+// doubling the target every HalfLife seconds of drift.
+type ASERT struct {
+	TargetSpacing   int64
+	HalfLife        int64
+	AnchorTimestamp int64
+	AnchorBits      uint32
+	PowLimitBits    uint32
+}
+
+func (algorithm ASERT) Window() int {
+	return 1
+}
+
+func (algorithm ASERT) NextBits(ancestors []BlockHeader) uint32 {
+	parent := ancestors[len(ancestors)-1]
+	drift := parent.Timestamp - algorithm.AnchorTimestamp - algorithm.TargetSpacing*parent.Index
+
+	// the exponent drift/HalfLife in 16 bit fixed point, split into whole
+	// halvings and a fraction whose power of two is approximated by a cubic
+	// polynomial, so that every node computes exactly the same target
+	exponent := drift * 65536 / algorithm.HalfLife
+	if drift < 0 && (drift*65536)%algorithm.HalfLife != 0 {
+		exponent--
+	}
+	shifts := exponent >> 16
+	frac := uint64(exponent & 0xffff)
+	factor := 65536 + ((195766423245049*frac + 971821376*frac*frac + 5127*frac*frac*frac + 1<<47) >> 48)
+
+	target := CompactToBig(algorithm.AnchorBits)
+	target.Mul(target, new(big.Int).SetUint64(factor))
+	if shifts -= 16; shifts < 0 {
+		target.Rsh(target, uint(-shifts))
+	} else {
+		target.Lsh(target, uint(shifts))
+	}
+
+	return limitTarget(target, algorithm.PowLimitBits)
+}
+
+// limitTarget returns the compact form of target, kept between one and the
+// easiest target of the network.
+func limitTarget(target *big.Int, powLimitBits uint32) uint32 {
+	if target.Sign() <= 0 {
+		return BigToCompact(bigOne)
+	}
+
+	if target.Cmp(CompactToBig(powLimitBits)) > 0 {
+		return powLimitBits
+	}
+	return BigToCompact(target)
+}
+
+// NewDifficultyAlgorithm returns the algorithm the chain parameters select.
+func NewDifficultyAlgorithm(chainParams *params.ChainParams) DifficultyAlgorithm {
+	if chainParams.NoRetargeting {
+		return FixedDifficulty{Bits: chainParams.GenesisBits}
+	}
+
+	spacing := int64(chainParams.BlockGenerationInterval)
+	switch chainParams.DifficultyAlgorithm {
+	case params.DIFFICULTY_LWMA:
+		return LWMA{WindowSize: chainParams.DifficultyWindow, TargetSpacing: spacing, PowLimitBits: chainParams.PowLimitBits}
+	case params.DIFFICULTY_ASERT:
+		return ASERT{
+			TargetSpacing:   spacing,
+			HalfLife:        chainParams.DifficultyHalfLife,
+			AnchorTimestamp: chainParams.GenesisTimestamp,
+			AnchorBits:      chainParams.GenesisBits,
+			PowLimitBits:    chainParams.PowLimitBits,
+		}
+	default:
+		return IntervalRetarget{
+			Interval:      chainParams.DifficultyAdjustmentInterval,
+			TargetSpacing: spacing,
+			PowLimitBits:  chainParams.PowLimitBits,
+		}
+	}
+}
+
+// expectedBits returns the target of the block following the last of
+// ancestors, the whole branch from the genesis block.
+func expectedBits(ancestors []BlockHeader) uint32 {
+	algorithm := NewDifficultyAlgorithm(params.Active())
+	if window := algorithm.Window(); len(ancestors) > window {
+		ancestors = ancestors[len(ancestors)-window:]
+	}
+
+	return algorithm.NextBits(ancestors)
+}
+
+// nextBits returns the target of a child of parent, on the main chain or a
+// side branch.
+func nextBits(parent *blockNode) uint32 {
+	algorithm := NewDifficultyAlgorithm(params.Active())
+
+	return algorithm.NextBits(ancestorHeaders(parent, algorithm.Window()))
+}
+
+// ancestorHeaders returns the headers of the last count blocks of the branch
+// ending at node, ordered by height.
+func ancestorHeaders(node *blockNode, count int) []BlockHeader {
+	ancestors := make([]BlockHeader, 0, count)
+	for ; node != nil && len(ancestors) < count; node = node.parent {
+		ancestors = append(ancestors, node.block.Header())
+	}
+
+	// the walk went from the node backwards
+	for i, j := 0, len(ancestors)-1; i < j; i, j = i+1, j-1 {
+		ancestors[i], ancestors[j] = ancestors[j], ancestors[i]
+	}
+
+	return ancestors
+}
+
+// GetNextBits returns the target of the block following the tip.
+func GetNextBits() uint32 {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	return nextBits(tree.tip)
+}
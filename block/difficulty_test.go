@@ -0,0 +1,80 @@
+package block_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/go-naivecoin/block"
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	BITS      = uint32(0x1e00ffff)
+	POW_LIMIT = uint32(0x207fffff)
+)
+
+func headers(bits uint32, spacing int64, count int) []block.BlockHeader {
+	var ancestors []block.BlockHeader
+	for i := 0; i < count; i++ {
+		ancestors = append(ancestors, block.BlockHeader{Index: int64(i), Timestamp: 1000 + int64(i)*spacing, Bits: bits})
+	}
+	return ancestors
+}
+
+// scaled returns the compact form of the target of bits times num/den.
+func scaled(bits uint32, num int64, den int64) uint32 {
+	target := block.CompactToBig(bits)
+	target.Mul(target, big.NewInt(num))
+	return block.BigToCompact(target.Div(target, big.NewInt(den)))
+}
+
+func TestIntervalRetarget_OnlyAdjustsAtInterval(t *testing.T) {
+	algorithm := block.IntervalRetarget{Interval: 10, TargetSpacing: 10, PowLimitBits: POW_LIMIT}
+
+	assert.Equal(t, BITS, algorithm.NextBits(headers(BITS, 1, 10)))
+	assert.Equal(t, scaled(BITS, 1, 4), algorithm.NextBits(headers(BITS, 1, 11)[1:]))
+	assert.Equal(t, scaled(BITS, 270, 100), algorithm.NextBits(headers(BITS, 30, 11)[1:]))
+	assert.Equal(t, scaled(BITS, 90, 100), algorithm.NextBits(headers(BITS, 10, 11)[1:]))
+	assert.Equal(t, POW_LIMIT, algorithm.NextBits(headers(POW_LIMIT, 30, 11)[1:]))
+}
+
+func TestLWMA_FollowsSolveTimes(t *testing.T) {
+	algorithm := block.LWMA{WindowSize: 20, TargetSpacing: 10, PowLimitBits: POW_LIMIT}
+
+	assert.Equal(t, BITS, algorithm.NextBits(headers(BITS, 10, 21)))
+	assert.Equal(t, scaled(BITS, 1, 5), algorithm.NextBits(headers(BITS, 2, 21)))
+	assert.Equal(t, scaled(BITS, 4, 1), algorithm.NextBits(headers(BITS, 40, 21)))
+}
+
+func TestASERT_FollowsSchedule(t *testing.T) {
+	algorithm := block.ASERT{TargetSpacing: 10, HalfLife: 100, AnchorTimestamp: 1000, AnchorBits: BITS, PowLimitBits: POW_LIMIT}
+
+	onSchedule := block.BlockHeader{Index: 50, Timestamp: 1500, Bits: BITS}
+	ahead := block.BlockHeader{Index: 50, Timestamp: 1300, Bits: BITS}
+	behind := block.BlockHeader{Index: 50, Timestamp: 1800, Bits: BITS}
+	halfBehind := block.BlockHeader{Index: 50, Timestamp: 1550, Bits: BITS}
+
+	assert.Equal(t, BITS, algorithm.NextBits([]block.BlockHeader{onSchedule}))
+	assert.Equal(t, scaled(BITS, 1, 4), algorithm.NextBits([]block.BlockHeader{ahead}))
+	assert.Equal(t, scaled(BITS, 8, 1), algorithm.NextBits([]block.BlockHeader{behind}))
+
+	// half a half life behind makes the target about sqrt(2) times easier
+	ratio, _ := new(big.Float).Quo(
+		new(big.Float).SetInt(block.CompactToBig(algorithm.NextBits([]block.BlockHeader{halfBehind}))),
+		new(big.Float).SetInt(block.CompactToBig(BITS))).Float64()
+	assert.InDelta(t, 1.41421356, ratio, 0.001)
+}
+
+func TestAddBlockToChain_WrongBits_ThenRejected(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	previous := block.GetLatestBlock()
+	data := []tx.Transaction{tx.GetCoinbaseTransaction(ADDRESS, previous.Index+1)}
+	easier := block.FindBlock(previous.Index+1, previous.Hash, nextTimestamp(previous), data, 0x2100ffff)
+
+	assert.Equal(t, previous.Bits, block.GetNextBits())
+	assert.Equal(t, block.ErrBadBits, errors.Cause(block.AddBlockToChain(easier)))
+}
@@ -0,0 +1,137 @@
+package block
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/go-naivecoin/tx"
+	"github.com/go-naivecoin/wire"
+	"github.com/pkg/errors"
+)
+
+// BLOCK_ENCODING_VERSION is the first field of every encoded block header.
+const BLOCK_ENCODING_VERSION = 1
+
+// minTxSize is the smallest encoding of a transaction, to bound the list a
+// decoder allocates.
+const minTxSize = 1 + 4 + 1 + 1
+
+// BlockHeader is a block without its transactions, which the merkle root
+// commits to. The block hash is the hash of its encoding.
+type BlockHeader struct {
+	Index        int64  `json:"index"`
+	PreviousHash string `json:"previousHash"`
+	Timestamp    int64  `json:"timestamp"`
+	MerkleRoot   string `json:"merkleRoot"`
+	Bits         uint32 `json:"bits"`
+	Nonce        int64  `json:"nonce"`
+}
+
+func (block Block) Header() BlockHeader {
+	return BlockHeader{
+		Index:        block.Index,
+		PreviousHash: block.PreviousHash,
+		Timestamp:    block.Timestamp,
+		MerkleRoot:   block.MerkleRoot,
+		Bits:         block.Bits,
+		Nonce:        block.Nonce,
+	}
+}
+
+// encode writes the version and the fields of the header, the nonce last.
+func (header BlockHeader) encode(w *wire.Writer) {
+	w.WriteUint32(BLOCK_ENCODING_VERSION)
+	w.WriteInt64(header.Index)
+	w.WriteString(header.PreviousHash)
+	w.WriteInt64(header.Timestamp)
+	w.WriteString(header.MerkleRoot)
+	w.WriteUint32(header.Bits)
+	w.WriteInt64(header.Nonce)
+}
+
+func (header *BlockHeader) decode(r *wire.Reader) error {
+	if version := r.ReadUint32(); r.Err() == nil && version != BLOCK_ENCODING_VERSION {
+		return errors.Errorf("unknown block encoding version %d", version)
+	}
+
+	header.Index = r.ReadInt64()
+	header.PreviousHash = r.ReadString()
+	header.Timestamp = r.ReadInt64()
+	header.MerkleRoot = r.ReadString()
+	header.Bits = r.ReadUint32()
+	header.Nonce = r.ReadInt64()
+	return r.Err()
+}
+
+func (header BlockHeader) MarshalBinary() ([]byte, error) {
+	var w wire.Writer
+	header.encode(&w)
+	return w.Bytes(), nil
+}
+
+func (header *BlockHeader) UnmarshalBinary(data []byte) error {
+	r := wire.NewReader(data)
+	if err := header.decode(r); err != nil {
+		return errors.Wrap(err, "BlockHeader-UnmarshalBinary")
+	}
+	return errors.Wrap(r.Close(), "BlockHeader-UnmarshalBinary")
+}
+
+// Hash returns the hash of the header encoding in hex.
+func (header BlockHeader) Hash() string {
+	var w wire.Writer
+	header.encode(&w)
+	bytes := sha256.Sum256(w.Bytes())
+	return fmt.Sprintf("%x", bytes)
+}
+
+// MarshalBinary returns the header encoding followed by the transactions,
+// each prefixed with its length.
+func (block Block) MarshalBinary() ([]byte, error) {
+	var w wire.Writer
+	block.Header().encode(&w)
+
+	w.WriteUvarint(uint64(len(block.Data)))
+	for _, transaction := range block.Data {
+		txBytes, err := transaction.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		w.WriteBytes(txBytes)
+	}
+
+	return w.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a block and computes its hash.
+func (block *Block) UnmarshalBinary(data []byte) error {
+	r := wire.NewReader(data)
+
+	var header BlockHeader
+	if err := header.decode(r); err != nil {
+		return errors.Wrap(err, "Block-UnmarshalBinary")
+	}
+
+	transactions := make([]tx.Transaction, r.ReadCount(minTxSize))
+	for i := range transactions {
+		if err := transactions[i].UnmarshalBinary(r.ReadBytes()); err != nil && r.Err() == nil {
+			return errors.Wrapf(err, "Block-UnmarshalBinary transaction %d", i)
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		return errors.Wrap(err, "Block-UnmarshalBinary")
+	}
+
+	*block = Block{
+		Index:        header.Index,
+		Hash:         header.Hash(),
+		PreviousHash: header.PreviousHash,
+		Timestamp:    header.Timestamp,
+		MerkleRoot:   header.MerkleRoot,
+		Data:         transactions,
+		Bits:         header.Bits,
+		Nonce:        header.Nonce,
+	}
+	return nil
+}
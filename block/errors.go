@@ -0,0 +1,24 @@
+package block
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Reasons a block is rejected. They are returned wrapped with the details of
+// the rejected block, errors.Cause tells them apart. Blocks with invalid
+// transactions are rejected with the errors of package tx.
+var (
+	ErrKnownBlock    = errors.New("block is already known")
+	ErrRejectedBlock = errors.New("the same copy of the block was already rejected")
+	ErrOrphanBlock   = errors.New("parent block is unknown")
+	ErrInvalidBranch = errors.New("block builds on an invalid branch")
+	ErrBadGenesis    = errors.New("genesis block does not match")
+	ErrBadIndex      = errors.New("block index does not follow its parent")
+	ErrBadPrevHash   = errors.New("previous hash does not match the parent")
+	ErrDuplicateTx   = errors.New("block holds the same transaction twice")
+	ErrBadMerkleRoot = errors.New("merkle root does not match the transactions")
+	ErrBadHash       = errors.New("hash does not match the block content")
+	ErrBadTimestamp  = errors.New("invalid block timestamp")
+	ErrTargetNotMet  = errors.New("block hash does not meet the target")
+	ErrBadBits       = errors.New("bits do not match the expected target")
+)
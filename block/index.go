@@ -0,0 +1,138 @@
+package block
+
+import (
+	"sync"
+
+	"github.com/go-naivecoin/tx"
+)
+
+// TransactionLocation tells in which block of the main chain, and at which
+// position of its data, a transaction was included.
+type TransactionLocation struct {
+	BlockIndex int64  `json:"blockIndex"`
+	BlockHash  string `json:"blockHash"`
+	Position   int    `json:"position"`
+}
+
+// chainIndex maps block hashes to heights and transaction ids to their
+// location in the main chain. Blocks by height are served by the store.
+type chainIndex struct {
+	mutex        sync.RWMutex
+	heightByHash map[string]int64
+	txLocations  map[string]TransactionLocation
+}
+
+func newChainIndex(blocks []Block) *chainIndex {
+	index := &chainIndex{}
+	index.rebuild(blocks)
+	return index
+}
+
+func (index *chainIndex) rebuild(blocks []Block) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.heightByHash = make(map[string]int64, len(blocks))
+	index.txLocations = make(map[string]TransactionLocation)
+	for _, block := range blocks {
+		index.add(block)
+	}
+}
+
+func (index *chainIndex) addBlock(block Block) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.add(block)
+}
+
+func (index *chainIndex) removeBlock(block Block) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	delete(index.heightByHash, block.Hash)
+	for _, transaction := range block.Data {
+		if location, found := index.txLocations[transaction.Id]; found && location.BlockHash == block.Hash {
+			delete(index.txLocations, transaction.Id)
+		}
+	}
+}
+
+func (index *chainIndex) add(block Block) {
+	index.heightByHash[block.Hash] = block.Index
+	for position, transaction := range block.Data {
+		index.txLocations[transaction.Id] = TransactionLocation{
+			BlockIndex: block.Index,
+			BlockHash:  block.Hash,
+			Position:   position,
+		}
+	}
+}
+
+func (index *chainIndex) height(hash string) (int64, bool) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	height, found := index.heightByHash[hash]
+	return height, found
+}
+
+func (index *chainIndex) txLocation(id string) (TransactionLocation, bool) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	location, found := index.txLocations[id]
+	return location, found
+}
+
+var chainIdx = newChainIndex([]Block{genesisBlock})
+
+// indexBlock records a block appended to the main chain in every index.
+func indexBlock(block Block) {
+	chainIdx.addBlock(block)
+	addrIdx.addBlock(block)
+}
+
+// unindexBlock removes the tip disconnected from the main chain from every
+// index.
+func unindexBlock(block Block) {
+	chainIdx.removeBlock(block)
+	addrIdx.removeBlock(block)
+}
+
+// reindexChain rebuilds every index after the main chain was replaced.
+func reindexChain(blocks []Block) {
+	chainIdx.rebuild(blocks)
+	addrIdx.rebuild(blocks)
+}
+
+func GetBlockByHeight(height int64) (Block, bool) {
+	return store.BlockAt(height)
+}
+
+func GetBlockByHash(hash string) (Block, bool) {
+	height, found := chainIdx.height(hash)
+	if !found {
+		return Block{}, false
+	}
+
+	return store.BlockAt(height)
+}
+
+func GetTransactionLocation(id string) (TransactionLocation, bool) {
+	return chainIdx.txLocation(id)
+}
+
+func GetTransaction(id string) (tx.Transaction, bool) {
+	location, found := chainIdx.txLocation(id)
+	if !found {
+		return tx.Transaction{}, false
+	}
+
+	block, found := store.BlockAt(location.BlockIndex)
+	if !found || location.Position >= len(block.Data) {
+		return tx.Transaction{}, false
+	}
+
+	return block.Data[location.Position], true
+}
@@ -0,0 +1,178 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/go-naivecoin/tx"
+)
+
+// MerkleProof is the branch of hashes linking a transaction id to the
+// merkle root of its block. Position is the index of the transaction in the
+// block data, which tells on which side each branch hash goes, and TxCount
+// the number of transactions of the block.
+type MerkleProof struct {
+	TxId     string   `json:"txId"`
+	Position int      `json:"position"`
+	TxCount  int      `json:"txCount"`
+	Branch   []string `json:"branch"`
+}
+
+func merkleLeaf(txId string) []byte {
+	leaf := sha256.Sum256([]byte(txId))
+	return leaf[:]
+}
+
+func merkleParent(left []byte, right []byte) []byte {
+	parent := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return parent[:]
+}
+
+// merkleLevels returns every level of the merkle tree over the transaction
+// ids, from the leaves up to the root. A level with an odd number of hashes
+// pairs its last hash with itself, so that repeating the last transactions
+// keeps the root: blocks with duplicate transactions are rejected.
+func merkleLevels(transactions []tx.Transaction) [][][]byte {
+	if len(transactions) == 0 {
+		return nil
+	}
+
+	level := make([][]byte, len(transactions))
+	for i, transaction := range transactions {
+		level[i] = merkleLeaf(transaction.Id)
+	}
+
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, merkleParent(level[i], right))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels
+}
+
+// hasDuplicateTxIds tells whether two transactions share an id.
+func hasDuplicateTxIds(transactions []tx.Transaction) bool {
+	seen := make(map[string]bool, len(transactions))
+	for _, transaction := range transactions {
+		if seen[transaction.Id] {
+			return true
+		}
+		seen[transaction.Id] = true
+	}
+	return false
+}
+
+// merkleDepth returns the number of levels above the leaves of a merkle
+// tree over count transactions.
+func merkleDepth(count int) int {
+	depth := 0
+	for ; count > 1; count = (count + 1) / 2 {
+		depth++
+	}
+	return depth
+}
+
+// CalculateMerkleRoot returns the hex merkle root of the transaction ids, or
+// an empty string for a block without transactions.
+func CalculateMerkleRoot(transactions []tx.Transaction) string {
+	levels := merkleLevels(transactions)
+	if levels == nil {
+		return ""
+	}
+
+	return hex.EncodeToString(levels[len(levels)-1][0])
+}
+
+// GetMerkleProof builds the proof that the transaction with txId is part of
+// the given block data.
+func GetMerkleProof(transactions []tx.Transaction, txId string) (MerkleProof, bool) {
+	position := -1
+	for i, transaction := range transactions {
+		if transaction.Id == txId {
+			position = i
+			break
+		}
+	}
+
+	if position < 0 {
+		return MerkleProof{}, false
+	}
+
+	levels := merkleLevels(transactions)
+	branch := make([]string, 0, len(levels)-1)
+	index := position
+	for _, level := range levels[:len(levels)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		branch = append(branch, hex.EncodeToString(level[sibling]))
+		index /= 2
+	}
+
+	return MerkleProof{TxId: txId, Position: position, TxCount: len(transactions), Branch: branch}, true
+}
+
+// VerifyMerkleProof tells whether the proof links its transaction id to the
+// hex merkleRoot. A hash pairs with itself only as the last one of a level
+// with an odd number of hashes, as GetMerkleProof builds it: claiming more
+// transactions than the block has, so that a repeated last transaction sits
+// at a position of its own, leaves equal siblings elsewhere.
+func VerifyMerkleProof(proof MerkleProof, merkleRoot string) bool {
+	if proof.Position < 0 || proof.Position >= proof.TxCount || len(proof.Branch) != merkleDepth(proof.TxCount) {
+		return false
+	}
+
+	hash := merkleLeaf(proof.TxId)
+	index := proof.Position
+	size := proof.TxCount
+
+	for _, siblingHex := range proof.Branch {
+		sibling, err := hex.DecodeString(siblingHex)
+		if err != nil {
+			return false
+		}
+
+		pairsWithItself := index == size-1 && size%2 == 1
+		if pairsWithItself != bytes.Equal(sibling, hash) {
+			return false
+		}
+		size = (size + 1) / 2
+
+		if index%2 == 0 {
+			hash = merkleParent(hash, sibling)
+		} else {
+			hash = merkleParent(sibling, hash)
+		}
+		index /= 2
+	}
+
+	return index == 0 && hex.EncodeToString(hash) == merkleRoot
+}
+
+// GetTransactionProof returns the merkle proof of a transaction of the main
+// chain along with the block that includes it.
+func GetTransactionProof(id string) (MerkleProof, Block, bool) {
+	location, found := GetTransactionLocation(id)
+	if !found {
+		return MerkleProof{}, Block{}, false
+	}
+
+	block, found := GetBlockByHeight(location.BlockIndex)
+	if !found {
+		return MerkleProof{}, Block{}, false
+	}
+
+	proof, found := GetMerkleProof(block.Data, id)
+	return proof, block, found
+}
@@ -0,0 +1,216 @@
+package block
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+)
+
+const (
+	// hashCheckInterval is how many nonces a worker tries between checks
+	// for cancellation and updates of the hash rate.
+	hashCheckInterval = 1024
+	hashRateWindow    = 5 * time.Second
+)
+
+var ErrStaleTip = errors.New("tip changed while mining")
+
+var minerThreads = int32(runtime.NumCPU())
+
+// SetMinerThreads sets how many goroutines search for a nonce, it takes
+// effect from the next block mined.
+func SetMinerThreads(threads int) {
+	if threads < 1 {
+		threads = 1
+	}
+	atomic.StoreInt32(&minerThreads, int32(threads))
+}
+
+func GetMinerThreads() int {
+	return int(atomic.LoadInt32(&minerThreads))
+}
+
+// hashRateMeter counts the hashes tried by the miner and turns them into a
+// hash rate over a window of a few seconds.
+type hashRateMeter struct {
+	mutex       sync.Mutex
+	windowStart time.Time
+	hashes      int64
+	rate        float64
+}
+
+func (meter *hashRateMeter) add(hashes int64) {
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+
+	now := time.Now()
+	if meter.windowStart.IsZero() {
+		meter.windowStart = now
+	}
+
+	meter.hashes += hashes
+	if elapsed := now.Sub(meter.windowStart); elapsed >= hashRateWindow {
+		meter.rate = float64(meter.hashes) / elapsed.Seconds()
+		meter.hashes = 0
+		meter.windowStart = now
+	}
+}
+
+func (meter *hashRateMeter) get() float64 {
+	meter.mutex.Lock()
+	defer meter.mutex.Unlock()
+
+	if elapsed := time.Since(meter.windowStart); elapsed >= hashRateWindow {
+		// nothing was mined during the last window
+		return float64(meter.hashes) / elapsed.Seconds()
+	}
+
+	return meter.rate
+}
+
+var hashMeter = &hashRateMeter{}
+
+// GetHashRate returns the hashes per second tried by the local miner.
+func GetHashRate() float64 {
+	return hashMeter.get()
+}
+
+// FindBlockContext splits the nonce space between threads workers, worker i
+// trying the nonces i, i+threads, i+2*threads and so on, until one of them
+// meets the target encoded in bits or ctx is done.
+func FindBlockContext(ctx context.Context, index int64, previousHash string, timestamp int64, data []tx.Transaction, bits uint32, threads int) (Block, error) {
+	if threads < 1 {
+		threads = 1
+	}
+
+	merkleRoot := CalculateMerkleRoot(data)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan Block, threads)
+	for worker := 0; worker < threads; worker++ {
+		go func(nonce int64) {
+			var hashes int64
+			for ; ; nonce += int64(threads) {
+				if hashes == hashCheckInterval {
+					hashMeter.add(hashes)
+					hashes = 0
+
+					select {
+					case <-ctx.Done():
+						return
+					default:
+					}
+				}
+
+				hash := calculateHash(index, previousHash, timestamp, merkleRoot, bits, nonce)
+				hashes++
+				if HasMatchesTarget(hash, bits) {
+					hashMeter.add(hashes)
+					found <- NewBlock(index, hash, previousHash, timestamp, data, bits, nonce)
+					return
+				}
+			}
+		}(int64(worker))
+	}
+
+	select {
+	case block := <-found:
+		return block, nil
+	case <-ctx.Done():
+		return Block{}, ctx.Err()
+	}
+}
+
+// TipChanged returns a channel that is closed the next time the tip of the
+// main chain changes.
+func TipChanged() <-chan struct{} {
+	tipMutex.Lock()
+	defer tipMutex.Unlock()
+
+	return tipChanged
+}
+
+var tipMutex sync.Mutex
+var tipChanged = make(chan struct{})
+
+func notifyTipChanged() {
+	tipMutex.Lock()
+	defer tipMutex.Unlock()
+
+	close(tipChanged)
+	tipChanged = make(chan struct{})
+}
+
+// mineOnTip mines a block on top of the current tip with the data built for
+// it. It gives up with ErrStaleTip once the tip changes.
+func mineOnTip(ctx context.Context, blockData func(previousBlock Block) []tx.Transaction) (*Block, error) {
+	changed := TipChanged()
+	chainMutex.Lock()
+	previousBlock := tree.tip.block
+	bits := nextBits(tree.tip)
+	timestamp := nextTimestamp(tree.tip)
+	chainMutex.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-changed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	newBlock, err := FindBlockContext(ctx, previousBlock.Index+1, previousBlock.Hash, timestamp, blockData(previousBlock), bits, GetMinerThreads())
+	if err != nil {
+		select {
+		case <-changed:
+			return nil, ErrStaleTip
+		default:
+			return nil, err
+		}
+	}
+
+	if err := AddBlockToChain(newBlock); err != nil {
+		return nil, errors.Wrap(err, "mined block was not accepted")
+	}
+
+	return &newBlock, nil
+}
+
+// MineNextBlock mines a block including the transaction pool, its coinbase
+// paying the block reward and the fees to address. Whenever another block arrives first it starts over
+// on the new tip, until ctx is done.
+func MineNextBlock(ctx context.Context, address string) (*Block, error) {
+	for {
+		newBlock, err := mineOnTip(ctx, func(previousBlock Block) []tx.Transaction {
+			chainMutex.Lock()
+			defer chainMutex.Unlock()
+
+			txPool := tx.GetTransactionPool()
+			fees, err := tx.GetTotalFees(txPool, GetUnpentTxOuts())
+			if err != nil {
+				log.Printf("mining without the transaction pool: %s", err.Error())
+				txPool, fees = nil, 0
+			}
+			coinbaseTx := tx.GetCoinbaseTransactionWithFees(address, previousBlock.Index+1, fees)
+			return append([]tx.Transaction{coinbaseTx}, txPool...)
+		})
+
+		if err == ErrStaleTip {
+			log.Printf("tip changed to %s while mining, starting over", GetLatestBlock().Hash)
+			continue
+		}
+
+		return newBlock, err
+	}
+}
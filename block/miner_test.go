@@ -0,0 +1,123 @@
+package block_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-naivecoin/block"
+	"github.com/go-naivecoin/tx"
+	"github.com/go-naivecoin/wallet"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindBlockContext_SeveralThreads_ThenMatchesDifficulty(t *testing.T) {
+	newBlock, err := block.FindBlockContext(context.Background(), 1, "9cbfae34f219c6c217ea85a24e94b912a7ec1dc894248bab67fcb27497533a7e", 1465154725, nil, block.DifficultyToBits(6), 4)
+
+	assert.Nil(t, err)
+	assert.True(t, block.HasMatchesTarget(newBlock.Hash, block.DifficultyToBits(6)))
+	assert.Equal(t, newBlock.Hash, block.NewBlock(1, "", newBlock.PreviousHash, newBlock.Timestamp, nil, block.DifficultyToBits(6), newBlock.Nonce).Hash)
+}
+
+func TestFindBlockContext_WhenCancelled_ThenStops(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := block.FindBlockContext(ctx, 1, "9cbfae34f219c6c217ea85a24e94b912a7ec1dc894248bab67fcb27497533a7e", 1465154725, nil, 256, 2)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, block.GetHashRate() >= 0)
+}
+
+func TestMineNextBlock_WhenTipChanges_ThenMinesOnNewTip(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	changed := block.TipChanged()
+	a1 := mineOn(block.GetLatestBlock(), OTHER_ADDRESS)
+	assert.Nil(t, block.AddBlockToChain(a1))
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("tip change was not notified")
+	}
+
+	newBlock, err := block.MineNextBlock(context.Background(), ADDRESS)
+
+	assert.Nil(t, err)
+	assert.Equal(t, a1.Hash, newBlock.PreviousHash)
+	assert.Equal(t, newBlock.Hash, block.GetLatestBlock().Hash)
+}
+
+func TestGetBlockTemplate_WhenSolved_ThenSubmitBlock(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	template, err := block.GetBlockTemplate(ADDRESS)
+	assert.Nil(t, err)
+	assert.Equal(t, block.GetLatestBlock().Hash, template.PreviousHash)
+	assert.Equal(t, int64(1), template.Index)
+	assert.Equal(t, block.CalculateMerkleRoot(template.Data()), template.MerkleRoot)
+
+	solved := block.FindBlock(template.Index, template.PreviousHash, template.Timestamp, template.Data(), template.Bits)
+	assert.Equal(t, solved.Hash, template.Block(solved.Nonce).Hash)
+
+	assert.Nil(t, block.SubmitBlock(solved))
+	assert.Equal(t, solved.Hash, block.GetLatestBlock().Hash)
+	assert.NotNil(t, block.SubmitBlock(solved))
+}
+
+func TestGetBlockTemplate_InvalidAddress(t *testing.T) {
+	_, err := block.GetBlockTemplate("invalid")
+
+	assert.NotNil(t, err)
+}
+
+func TestGetBlockTemplate_PayToPubKeyHash(t *testing.T) {
+	pubKeyHash, err := tx.PayToPubKeyHashAddress(ADDRESS)
+	assert.Nil(t, err)
+
+	template, err := block.GetBlockTemplate(pubKeyHash)
+	assert.Nil(t, err)
+	assert.Equal(t, pubKeyHash, template.Coinbase.TxOuts[0].Address)
+}
+
+func TestMineNextBlock_CoinbaseClaimsFees(t *testing.T) {
+	defer useCoinbaseMaturity(1)()
+
+	myAddress, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	assert.Nil(t, block.AddBlockToChain(mineOn(block.GetLatestBlock(), myAddress)))
+	assert.Nil(t, block.AddBlockToChain(mineOn(block.GetLatestBlock(), OTHER_ADDRESS)))
+	spendHeight := block.GetLatestBlock().Index + 1
+
+	transaction, err := wallet.CreateTransaction(OTHER_ADDRESS, 10, 5, PRIVATE_KEY, block.GetUnpentTxOuts(), tx.GetTransactionPool(), spendHeight)
+	assert.Nil(t, err)
+	fee, err := transaction.GetFee(block.GetUnpentTxOuts())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), fee)
+	_, err = tx.AddToTransactionPool(transaction, block.GetUnpentTxOuts(), spendHeight, block.GetMedianTimePast())
+	assert.Nil(t, err)
+
+	newBlock, err := block.MineNextBlock(context.Background(), ADDRESS)
+	assert.Nil(t, err)
+	assert.Len(t, newBlock.Data, 2)
+	assert.Equal(t, int64(55), newBlock.Data[0].TxOuts[0].Amount)
+	assert.Empty(t, tx.GetTransactionPool())
+	spendable, immature := wallet.GetBalance(myAddress, block.GetUnpentTxOuts(), newBlock.Index+1)
+	assert.Equal(t, int64(35), spendable)
+	assert.Equal(t, int64(0), immature)
+}
+
+func TestAddBlockToChain_CoinbaseAboveRewardAndFees_ThenRejected(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	previous := block.GetLatestBlock()
+	coinbaseTx := tx.GetCoinbaseTransactionWithFees(ADDRESS, previous.Index+1, 1)
+	greedy := block.FindBlock(previous.Index+1, previous.Hash, nextTimestamp(previous), []tx.Transaction{coinbaseTx}, previous.Bits)
+
+	assert.Equal(t, tx.ErrBadCoinbase, errors.Cause(block.AddBlockToChain(greedy)))
+}
@@ -0,0 +1,266 @@
+package block
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	blocksFileName = "blocks.dat"
+)
+
+// BlockStore keeps the blocks of the main chain, ordered by index.
+type BlockStore interface {
+	Append(block Block) error
+	Replace(blocks []Block) error
+	Truncate(length int) error
+	Blocks() []Block
+	Latest() Block
+	BlockAt(index int64) (Block, bool)
+	Len() int
+}
+
+type MemoryBlockStore struct {
+	mutex  sync.RWMutex
+	blocks []Block
+}
+
+func NewMemoryBlockStore(genesis Block) *MemoryBlockStore {
+	return &MemoryBlockStore{blocks: []Block{genesis}}
+}
+
+func (s *MemoryBlockStore) Append(block Block) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.blocks = append(s.blocks, block)
+	return nil
+}
+
+func (s *MemoryBlockStore) Replace(blocks []Block) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.blocks = append([]Block(nil), blocks...)
+	return nil
+}
+
+func (s *MemoryBlockStore) Truncate(length int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if length < 1 || length > len(s.blocks) {
+		return errors.Errorf("cannot truncate %d blocks to %d", len(s.blocks), length)
+	}
+
+	s.blocks = s.blocks[:length]
+	return nil
+}
+
+func (s *MemoryBlockStore) Blocks() []Block {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]Block(nil), s.blocks...)
+}
+
+func (s *MemoryBlockStore) Latest() Block {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.blocks[len(s.blocks)-1]
+}
+
+func (s *MemoryBlockStore) BlockAt(index int64) (Block, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if index < 0 || index >= int64(len(s.blocks)) {
+		return Block{}, false
+	}
+
+	return s.blocks[index], true
+}
+
+func (s *MemoryBlockStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.blocks)
+}
+
+// FileBlockStore appends every block as one json line to blocks.dat under
+// its data directory and keeps a copy of the chain in memory for reads.
+type FileBlockStore struct {
+	MemoryBlockStore
+	path string
+	file *os.File
+}
+
+func NewFileBlockStore(dataDir string, genesis Block) (*FileBlockStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "NewFileBlockStore-MkdirAll")
+	}
+
+	s := &FileBlockStore{path: filepath.Join(dataDir, blocksFileName)}
+
+	blocks, err := readBlocksFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blocks) == 0 {
+		if err := s.Replace([]Block{genesis}); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	if blocks[0].Hash != genesis.Hash {
+		return nil, errors.Errorf("genesis block %s in %s does not match %s", blocks[0].Hash, s.path, genesis.Hash)
+	}
+
+	// rewrite the file so that a partially written last line is dropped
+	if err := s.Replace(blocks); err != nil {
+		return nil, err
+	}
+
+	log.Printf("loaded %d blocks from %s", len(blocks), s.path)
+	return s, nil
+}
+
+func readBlocksFile(path string) ([]Block, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "readBlocksFile-Open")
+	}
+	defer file.Close()
+
+	var blocks []Block
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var block Block
+		if err := json.Unmarshal(scanner.Bytes(), &block); err != nil {
+			// only the last line may have been cut short by a crash
+			if scanner.Scan() {
+				return nil, errors.Wrapf(err, "unreadable block at line %d of %s", len(blocks)+1, path)
+			}
+			log.Printf("ignoring unreadable last block after index %d in %s: %s", len(blocks)-1, path, err.Error())
+			break
+		}
+		if block.Index != int64(len(blocks)) {
+			return nil, errors.Errorf("unexpected block index %d at line %d of %s", block.Index, len(blocks)+1, path)
+		}
+		blocks = append(blocks, block)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "readBlocksFile-Scan")
+	}
+
+	return blocks, nil
+}
+
+func (s *FileBlockStore) Append(block Block) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := writeBlockLine(s.file, block); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return errors.Wrap(err, "FileBlockStore.Append-Sync")
+	}
+
+	s.blocks = append(s.blocks, block)
+	return nil
+}
+
+// Replace writes the new chain to a temporary file and renames it over
+// blocks.dat, so a crash leaves either the old or the new chain on disk.
+func (s *FileBlockStore) Replace(blocks []Block) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tmpPath := s.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "FileBlockStore.Replace-OpenFile")
+	}
+
+	for _, block := range blocks {
+		if err := writeBlockLine(tmpFile, block); err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "FileBlockStore.Replace-Sync")
+	}
+	tmpFile.Close()
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return errors.Wrap(err, "FileBlockStore.Replace-Rename")
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "FileBlockStore.Replace-OpenFile")
+	}
+
+	s.file = file
+	s.blocks = append([]Block(nil), blocks...)
+	return nil
+}
+
+// Truncate drops the blocks from index length onwards, rewriting the file.
+func (s *FileBlockStore) Truncate(length int) error {
+	blocks := s.Blocks()
+	if length < 1 || length > len(blocks) {
+		return errors.Errorf("cannot truncate %d blocks to %d", len(blocks), length)
+	}
+
+	return s.Replace(blocks[:length])
+}
+
+func (s *FileBlockStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func writeBlockLine(file *os.File, block Block) error {
+	bytes, err := json.Marshal(block)
+	if err != nil {
+		return errors.Wrap(err, "writeBlockLine-Marshal")
+	}
+
+	if _, err := file.Write(append(bytes, '\n')); err != nil {
+		return errors.Wrap(err, "writeBlockLine-Write")
+	}
+
+	return nil
+}
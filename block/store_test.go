@@ -0,0 +1,112 @@
+package block_test
+
+import (
+	"encoding/json"
+	"github.com/go-naivecoin/block"
+	"github.com/go-naivecoin/tx"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileBlockStore_ReopenAtSameTip(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "blockstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataDir)
+
+	genesis := block.NewBlock(0, "", "", 1465154705, nil, 0, 0)
+	next := block.NewBlock(1, "", genesis.Hash, 1465154715, nil, 0, 0)
+
+	store, err := block.NewFileBlockStore(dataDir, genesis)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Append(next))
+	store.Close()
+
+	reopened, err := block.NewFileBlockStore(dataDir, genesis)
+	assert.Nil(t, err)
+	defer reopened.Close()
+
+	assert.Equal(t, 2, reopened.Len())
+	assert.Equal(t, next.Hash, reopened.Latest().Hash)
+}
+
+func TestFileBlockStore_DropsPartialLastLine(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "blockstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataDir)
+
+	genesis := block.NewBlock(0, "", "", 1465154705, nil, 0, 0)
+
+	store, err := block.NewFileBlockStore(dataDir, genesis)
+	assert.Nil(t, err)
+	store.Close()
+
+	file, err := os.OpenFile(filepath.Join(dataDir, "blocks.dat"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	file.WriteString(`{"index":1,"hash":"ab`)
+	file.Close()
+
+	reopened, err := block.NewFileBlockStore(dataDir, genesis)
+	assert.Nil(t, err)
+	defer reopened.Close()
+
+	assert.Equal(t, 1, reopened.Len())
+	assert.Equal(t, genesis.Hash, reopened.Latest().Hash)
+}
+
+func TestFileBlockStore_RejectsCorruptMiddleLine(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "blockstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataDir)
+
+	genesis := block.NewBlock(0, "", "", 1465154705, nil, 0, 0)
+	next := block.NewBlock(1, "", genesis.Hash, 1465154715, nil, 0, 0)
+
+	store, err := block.NewFileBlockStore(dataDir, genesis)
+	assert.Nil(t, err)
+	store.Close()
+
+	file, err := os.OpenFile(filepath.Join(dataDir, "blocks.dat"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	file.WriteString("{\"index\":1,\"hash\":\"ab\n")
+	nextBytes, err := json.Marshal(next)
+	assert.Nil(t, err)
+	file.Write(append(nextBytes, '\n'))
+	file.Close()
+
+	_, err = block.NewFileBlockStore(dataDir, genesis)
+	assert.NotNil(t, err)
+}
+
+func TestInitBlockStore_RestoresUnspentTxOuts(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "blockstore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataDir)
+	defer block.InitBlockStore("")
+
+	assert.Nil(t, block.InitBlockStore(dataDir))
+	utxos := block.GetUnpentTxOuts()
+
+	_, err = os.Stat(filepath.Join(dataDir, "utxos.json"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, block.InitBlockStore(dataDir))
+	assert.Equal(t, utxos, block.GetUnpentTxOuts())
+
+	// a marker output that replaying the blockchain would not produce
+	path := filepath.Join(dataDir, "utxos.json")
+	snapshotBytes, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	var snapshot map[string]interface{}
+	assert.Nil(t, json.Unmarshal(snapshotBytes, &snapshot))
+	marker := tx.UnspentTxOut{TxOutId: "marker", Address: "marker", Amount: 1}
+	snapshot["unspentTxOuts"] = append(utxos, marker)
+	snapshotBytes, err = json.Marshal(snapshot)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path, snapshotBytes, 0644))
+
+	assert.Nil(t, block.InitBlockStore(dataDir))
+	assert.Equal(t, append(utxos, marker), block.GetUnpentTxOuts())
+}
@@ -0,0 +1,45 @@
+package block
+
+import (
+	"github.com/go-naivecoin/params"
+)
+
+// Supply reports the coins in existence on the main chain. Issued is the
+// sum of the unspent transaction outputs, which is below the scheduled
+// supply when miners claimed less than they could.
+type Supply struct {
+	Height          int64 `json:"height"`
+	Issued          int64 `json:"issued"`
+	ScheduledSupply int64 `json:"scheduledSupply"`
+	NextSubsidy     int64 `json:"nextSubsidy"`
+	// MaxSupply and Remaining, what the blocks to come may still issue, are
+	// only set when Capped.
+	Capped    bool  `json:"capped"`
+	MaxSupply int64 `json:"maxSupply"`
+	Remaining int64 `json:"remaining"`
+}
+
+func GetSupply() Supply {
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	chainParams := params.Active()
+	height := GetLatestBlock().Index
+
+	supply := Supply{
+		Height:          height,
+		ScheduledSupply: chainParams.ScheduledSupply(height),
+		NextSubsidy:     chainParams.BlockSubsidy(height + 1),
+	}
+
+	for _, utxo := range GetUnpentTxOuts() {
+		supply.Issued += utxo.Amount
+	}
+
+	supply.MaxSupply, supply.Capped = chainParams.MaxSupply()
+	if supply.Capped {
+		supply.Remaining = supply.MaxSupply - supply.ScheduledSupply
+	}
+
+	return supply
+}
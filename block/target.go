@@ -0,0 +1,107 @@
+package block
+
+import (
+	"math/big"
+
+	"github.com/go-naivecoin/params"
+)
+
+var bigOne = big.NewInt(1)
+
+// CompactToBig expands the compact "bits" form of a target: the high byte
+// is the length of the target in bytes and the low 23 bits its leading
+// digits, bit 23 being the sign.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		target = big.NewInt(mantissa >> (8 * (3 - exponent)))
+	} else {
+		target = new(big.Int).Lsh(big.NewInt(mantissa), 8*(exponent-3))
+	}
+
+	if compact&0x00800000 != 0 {
+		target.Neg(target)
+	}
+	return target
+}
+
+// BigToCompact returns the compact form of target, rounding it down to its
+// three leading bytes.
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	abs := new(big.Int).Abs(target)
+	exponent := uint(len(abs.Bytes()))
+
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(abs.Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(abs, 8*(exponent-3)).Uint64())
+	}
+
+	// the mantissa is signed, a set high bit goes into the next byte
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// DifficultyToBits returns the target of hashes starting with
+// leadingZeroBits zero bits, the way difficulty used to be expressed.
+func DifficultyToBits(leadingZeroBits int) uint32 {
+	target := new(big.Int).Lsh(bigOne, uint(256-leadingZeroBits))
+	return BigToCompact(target.Sub(target, bigOne))
+}
+
+// HasMatchesTarget tells whether the hex hash, read as a number, is at most
+// the target encoded in bits.
+func HasMatchesTarget(hash string, bits uint32) bool {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return false
+	}
+
+	hashNum, ok := new(big.Int).SetString(hash, 16)
+	if !ok {
+		return false
+	}
+
+	return hashNum.Cmp(target) <= 0
+}
+
+// CalcWork returns the expected number of hashes to find a block at bits,
+// 2^256 / (target + 1).
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+
+	numerator := new(big.Int).Lsh(bigOne, 256)
+	return numerator.Div(numerator, target.Add(target, bigOne))
+}
+
+// GetDifficulty returns how many times harder than the easiest target of
+// the network a block at bits is to find.
+func GetDifficulty(bits uint32) float64 {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	powLimit := new(big.Float).SetInt(CompactToBig(params.Active().PowLimitBits))
+	difficulty, _ := powLimit.Quo(powLimit, new(big.Float).SetInt(target)).Float64()
+	return difficulty
+}
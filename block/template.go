@@ -0,0 +1,66 @@
+package block
+
+import (
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+)
+
+// BlockTemplate is the work handed to an external miner: everything needed
+// to build the next block except the nonce.
+type BlockTemplate struct {
+	Index        int64            `json:"index"`
+	PreviousHash string           `json:"previousHash"`
+	Timestamp    int64            `json:"timestamp"`
+	Bits         uint32           `json:"bits"`
+	Fees         int64            `json:"fees"`
+	Coinbase     tx.Transaction   `json:"coinbase"`
+	Transactions []tx.Transaction `json:"transactions"`
+	MerkleRoot   string           `json:"merkleRoot"`
+}
+
+// Data returns the block data of the template, the coinbase first.
+func (template BlockTemplate) Data() []tx.Transaction {
+	return append([]tx.Transaction{template.Coinbase}, template.Transactions...)
+}
+
+// Block returns the block built from the template with nonce.
+func (template BlockTemplate) Block(nonce int64) Block {
+	return NewBlock(template.Index, "", template.PreviousHash, template.Timestamp, template.Data(), template.Bits, nonce)
+}
+
+// GetBlockTemplate returns a template for the block following the current
+// tip, including the transaction pool, its coinbase paying the block reward
+// and the fees to address.
+func GetBlockTemplate(address string) (BlockTemplate, error) {
+	if !tx.IsValidAddress(address) {
+		return BlockTemplate{}, errors.New("Invalid address")
+	}
+
+	chainMutex.Lock()
+	defer chainMutex.Unlock()
+
+	previousBlock := GetLatestBlock()
+	txPool := tx.GetTransactionPool()
+	fees, err := tx.GetTotalFees(txPool, GetUnpentTxOuts())
+	if err != nil {
+		return BlockTemplate{}, err
+	}
+
+	template := BlockTemplate{
+		Index:        previousBlock.Index + 1,
+		PreviousHash: previousBlock.Hash,
+		Timestamp:    nextTimestamp(tree.tip),
+		Bits:         nextBits(tree.tip),
+		Fees:         fees,
+		Coinbase:     tx.GetCoinbaseTransactionWithFees(address, previousBlock.Index+1, fees),
+		Transactions: txPool,
+	}
+	template.MerkleRoot = CalculateMerkleRoot(template.Data())
+
+	return template, nil
+}
+
+// SubmitBlock adds a block solved by an external miner to the chain.
+func SubmitBlock(newBlock Block) error {
+	return AddBlockToChain(newBlock)
+}
@@ -0,0 +1,105 @@
+package block
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTimeSamples is how many peers the clock offset is sampled from.
+	maxTimeSamples = 200
+	// minTimeSamples is how many peers must report their time before the
+	// node adjusts its clock.
+	minTimeSamples = 5
+	// maxTimeAdjustment is the largest offset, in seconds, the peers may
+	// apply to the local clock. Beyond it the local clock is trusted.
+	maxTimeAdjustment = 70 * 60
+)
+
+// timeSample is the offset a source reported first, and how many
+// connections from it are sampled.
+type timeSample struct {
+	offset      int64
+	connections int
+}
+
+var timeMutex sync.Mutex
+var timeSamples = make(map[string]*timeSample)
+var timeOffset int64
+
+// AddTimeSample records how many seconds the clock of the peer at source, its
+// IP address, is ahead of the local clock. The network-adjusted time is the
+// local time plus the median of the samples. A source counts once however
+// many connections it opens: their samples only keep its first one.
+func AddTimeSample(source string, offset int64) {
+	timeMutex.Lock()
+	defer timeMutex.Unlock()
+
+	if sample, known := timeSamples[source]; known {
+		sample.connections++
+		return
+	} else if len(timeSamples) >= maxTimeSamples {
+		return
+	}
+
+	timeSamples[source] = &timeSample{offset: offset, connections: 1}
+	updateTimeOffset()
+}
+
+// RemoveTimeSample forgets the time reported by source once its last sampled
+// connection is closed.
+func RemoveTimeSample(source string) {
+	timeMutex.Lock()
+	defer timeMutex.Unlock()
+
+	sample, known := timeSamples[source]
+	if !known {
+		return
+	}
+
+	sample.connections--
+	if sample.connections == 0 {
+		delete(timeSamples, source)
+		updateTimeOffset()
+	}
+}
+
+func updateTimeOffset() {
+	if len(timeSamples) < minTimeSamples {
+		timeOffset = 0
+		return
+	}
+
+	offsets := make([]int64, 0, len(timeSamples))
+	for _, sample := range timeSamples {
+		offsets = append(offsets, sample.offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	median := offsets[len(offsets)/2]
+	if median > maxTimeAdjustment || median < -maxTimeAdjustment {
+		log.Printf("peers report a clock %d seconds away from ours, please check the local clock", median)
+		timeOffset = 0
+		return
+	}
+
+	timeOffset = median
+}
+
+// GetTimeOffset returns the offset in seconds between the network-adjusted
+// time and the local clock, and how many peers it was sampled from.
+func GetTimeOffset() (int64, int) {
+	timeMutex.Lock()
+	defer timeMutex.Unlock()
+
+	return timeOffset, len(timeSamples)
+}
+
+// AdjustedNow returns the node clock corrected by the time of its peers,
+// which blocks are timestamped and validated against.
+func AdjustedNow() time.Time {
+	offset, _ := GetTimeOffset()
+	return Now().Add(time.Duration(offset) * time.Second)
+}
@@ -0,0 +1,75 @@
+package block_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-naivecoin/block"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddTimeSample_ThenAdjustedNowFollowsMedian(t *testing.T) {
+	now := time.Unix(1535760000, 0)
+	block.SetClock(func() time.Time {
+		return now
+	})
+	defer block.SetClock(nil)
+
+	offsets := []int64{30, -10, 20, 25, 600}
+	for i, offset := range offsets {
+		source := fmt.Sprintf("peer%d", i)
+		block.AddTimeSample(source, offset)
+		defer block.RemoveTimeSample(source)
+	}
+
+	offset, samples := block.GetTimeOffset()
+	assert.Equal(t, int64(25), offset)
+	assert.Equal(t, 5, samples)
+	assert.Equal(t, now.Unix()+25, block.AdjustedNow().Unix())
+
+	// too few peers to trust
+	block.RemoveTimeSample("peer4")
+	offset, _ = block.GetTimeOffset()
+	assert.Equal(t, int64(0), offset)
+}
+
+func TestAddTimeSample_OffsetTooLarge_ThenIgnored(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		source := fmt.Sprintf("far%d", i)
+		block.AddTimeSample(source, 2*60*60)
+		defer block.RemoveTimeSample(source)
+	}
+
+	offset, samples := block.GetTimeOffset()
+	assert.Equal(t, int64(0), offset)
+	assert.Equal(t, 5, samples)
+}
+
+func TestAddTimeSample_SameSource_ThenCountedOnce(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		source := fmt.Sprintf("honest%d", i)
+		block.AddTimeSample(source, 0)
+		defer block.RemoveTimeSample(source)
+	}
+
+	// more connections from one host neither add samples nor move its first
+	for i := 0; i < 5; i++ {
+		block.AddTimeSample("10.0.0.1", int64(60*60+i))
+	}
+
+	offset, samples := block.GetTimeOffset()
+	assert.Equal(t, int64(0), offset)
+	assert.Equal(t, 5, samples)
+
+	// the sample stays until the last connection of the host closes
+	for i := 0; i < 4; i++ {
+		block.RemoveTimeSample("10.0.0.1")
+	}
+	_, samples = block.GetTimeOffset()
+	assert.Equal(t, 5, samples)
+
+	block.RemoveTimeSample("10.0.0.1")
+	_, samples = block.GetTimeOffset()
+	assert.Equal(t, 4, samples)
+}
@@ -0,0 +1,163 @@
+package block
+
+import (
+	"math/big"
+)
+
+const (
+	CHAIN_TIP_ACTIVE        = "active"
+	CHAIN_TIP_VALID_FORK    = "valid-fork"
+	CHAIN_TIP_VALID_HEADERS = "valid-headers"
+	CHAIN_TIP_INVALID       = "invalid"
+)
+
+// blockNode is a block of the block tree together with the accumulated
+// work of the branch ending at it.
+type blockNode struct {
+	block     Block
+	parent    *blockNode
+	children  []*blockNode
+	work      *big.Int
+	validated bool
+	invalid   bool
+}
+
+// blockTree holds every block that connects to the genesis block, including
+// side branches, and points at the tip of the main chain.
+type blockTree struct {
+	nodes map[string]*blockNode
+	tip   *blockNode
+}
+
+// ChainTip describes the last block of a branch known to the node.
+type ChainTip struct {
+	Height    int64  `json:"height"`
+	Hash      string `json:"hash"`
+	BranchLen int64  `json:"branchLen"`
+	Status    string `json:"status"`
+}
+
+func blockWork(block Block) *big.Int {
+	return CalcWork(block.Bits)
+}
+
+// newBlockTree builds a tree holding only the given main chain.
+func newBlockTree(blocks []Block) *blockTree {
+	tree := &blockTree{nodes: make(map[string]*blockNode)}
+
+	var parent *blockNode
+	for _, block := range blocks {
+		node := tree.add(block, parent)
+		node.validated = true
+		parent = node
+	}
+
+	tree.tip = parent
+	return tree
+}
+
+func (tree *blockTree) add(block Block, parent *blockNode) *blockNode {
+	node := &blockNode{block: block, parent: parent, work: blockWork(block)}
+	if parent != nil {
+		node.work.Add(node.work, parent.work)
+		parent.children = append(parent.children, node)
+	}
+
+	tree.nodes[block.Hash] = node
+	return node
+}
+
+// remove drops node and its descendants from the tree.
+func (tree *blockTree) remove(node *blockNode) {
+	if parent := node.parent; parent != nil {
+		for i, child := range parent.children {
+			if child == node {
+				parent.children = append(parent.children[:i], parent.children[i+1:]...)
+				break
+			}
+		}
+	}
+
+	nodes := []*blockNode{node}
+	for len(nodes) > 0 {
+		node, nodes = nodes[len(nodes)-1], nodes[:len(nodes)-1]
+		delete(tree.nodes, node.block.Hash)
+		nodes = append(nodes, node.children...)
+	}
+}
+
+func (tree *blockTree) get(hash string) (*blockNode, bool) {
+	node, found := tree.nodes[hash]
+	return node, found
+}
+
+// findFork returns the last block that both branches have in common.
+func (tree *blockTree) findFork(a *blockNode, b *blockNode) *blockNode {
+	for a.block.Index > b.block.Index {
+		a = a.parent
+	}
+	for b.block.Index > a.block.Index {
+		b = b.parent
+	}
+	for a != b {
+		a = a.parent
+		b = b.parent
+	}
+	return a
+}
+
+// branch returns the nodes after fork up to and including tip, in order.
+func (tree *blockTree) branch(fork *blockNode, tip *blockNode) []*blockNode {
+	var nodes []*blockNode
+	for node := tip; node != fork; node = node.parent {
+		nodes = append([]*blockNode{node}, nodes...)
+	}
+	return nodes
+}
+
+// isInvalid tells whether the node or any of its ancestors failed to connect.
+func (node *blockNode) isInvalid() bool {
+	for ; node != nil; node = node.parent {
+		if node.invalid {
+			return true
+		}
+	}
+	return false
+}
+
+func (tree *blockTree) chainTips() []ChainTip {
+	tips := []ChainTip{{
+		Height:    tree.tip.block.Index,
+		Hash:      tree.tip.block.Hash,
+		BranchLen: 0,
+		Status:    CHAIN_TIP_ACTIVE,
+	}}
+
+	for _, node := range tree.nodes {
+		if len(node.children) > 0 || node == tree.tip {
+			continue
+		}
+
+		fork := tree.findFork(tree.tip, node)
+		status := CHAIN_TIP_VALID_FORK
+		if node.isInvalid() {
+			status = CHAIN_TIP_INVALID
+		} else {
+			for _, branchNode := range tree.branch(fork, node) {
+				if !branchNode.validated {
+					status = CHAIN_TIP_VALID_HEADERS
+					break
+				}
+			}
+		}
+
+		tips = append(tips, ChainTip{
+			Height:    node.block.Index,
+			Hash:      node.block.Hash,
+			BranchLen: node.block.Index - fork.block.Index,
+			Status:    status,
+		})
+	}
+
+	return tips
+}
@@ -0,0 +1,122 @@
+package block
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+)
+
+const (
+	undoDirName = "undo"
+)
+
+// BlockUndo is what connecting a block removed from the unspent transaction
+// outputs, so that the block can be disconnected again.
+type BlockUndo struct {
+	BlockHash   string           `json:"blockHash"`
+	SpentTxOuts tx.UnspentTxOuts `json:"spentTxOuts"`
+}
+
+// UndoStore keeps the undo data of connected blocks by block hash.
+type UndoStore interface {
+	Put(undo BlockUndo) error
+	Get(hash string) (BlockUndo, bool)
+	Delete(hash string) error
+}
+
+type MemoryUndoStore struct {
+	mutex sync.RWMutex
+	undos map[string]BlockUndo
+}
+
+func NewMemoryUndoStore() *MemoryUndoStore {
+	return &MemoryUndoStore{undos: make(map[string]BlockUndo)}
+}
+
+func (s *MemoryUndoStore) Put(undo BlockUndo) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.undos[undo.BlockHash] = undo
+	return nil
+}
+
+func (s *MemoryUndoStore) Get(hash string) (BlockUndo, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	undo, found := s.undos[hash]
+	return undo, found
+}
+
+func (s *MemoryUndoStore) Delete(hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.undos, hash)
+	return nil
+}
+
+// FileUndoStore writes the undo data of every block to its own json file
+// in the undo directory under the data directory.
+type FileUndoStore struct {
+	dir string
+}
+
+func NewFileUndoStore(dataDir string) (*FileUndoStore, error) {
+	dir := filepath.Join(dataDir, undoDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "NewFileUndoStore-MkdirAll")
+	}
+
+	return &FileUndoStore{dir: dir}, nil
+}
+
+func (s *FileUndoStore) path(hash string) string {
+	return filepath.Join(s.dir, hash+".json")
+}
+
+func (s *FileUndoStore) Put(undo BlockUndo) error {
+	bytes, err := json.Marshal(undo)
+	if err != nil {
+		return errors.Wrap(err, "FileUndoStore.Put-Marshal")
+	}
+
+	tmpPath := s.path(undo.BlockHash) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, bytes, 0644); err != nil {
+		return errors.Wrap(err, "FileUndoStore.Put-WriteFile")
+	}
+
+	if err := os.Rename(tmpPath, s.path(undo.BlockHash)); err != nil {
+		return errors.Wrap(err, "FileUndoStore.Put-Rename")
+	}
+
+	return nil
+}
+
+func (s *FileUndoStore) Get(hash string) (BlockUndo, bool) {
+	bytes, err := ioutil.ReadFile(s.path(hash))
+	if err != nil {
+		return BlockUndo{}, false
+	}
+
+	var undo BlockUndo
+	if err := json.Unmarshal(bytes, &undo); err != nil {
+		return BlockUndo{}, false
+	}
+
+	return undo, true
+}
+
+func (s *FileUndoStore) Delete(hash string) error {
+	if err := os.Remove(s.path(hash)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "FileUndoStore.Delete-Remove")
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package block
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+)
+
+const (
+	utxosFileName = "utxos.json"
+	// utxoSnapshotVersion changes with the fields of tx.UnspentTxOut, older
+	// snapshots are rebuilt from the blockchain.
+	utxoSnapshotVersion = 1
+)
+
+// utxoSnapshot is the on-disk form of the unspent transaction outputs,
+// tagged with the hash of the block they were computed up to.
+type utxoSnapshot struct {
+	Version       int              `json:"version"`
+	BestHash      string           `json:"bestHash"`
+	UnspentTxOuts tx.UnspentTxOuts `json:"unspentTxOuts"`
+}
+
+func saveUnspentTxOuts(dataDir string, bestHash string, aUnspentTxOuts tx.UnspentTxOuts) error {
+	bytes, err := json.Marshal(utxoSnapshot{Version: utxoSnapshotVersion, BestHash: bestHash, UnspentTxOuts: aUnspentTxOuts})
+	if err != nil {
+		return errors.Wrap(err, "saveUnspentTxOuts-Marshal")
+	}
+
+	path := filepath.Join(dataDir, utxosFileName)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, bytes, 0644); err != nil {
+		return errors.Wrap(err, "saveUnspentTxOuts-WriteFile")
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Wrap(err, "saveUnspentTxOuts-Rename")
+	}
+
+	return nil
+}
+
+// loadUnspentTxOuts returns the stored unspent transaction outputs and the
+// hash of the block they match, or an empty hash if nothing was stored yet.
+func loadUnspentTxOuts(dataDir string) (string, tx.UnspentTxOuts, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(dataDir, utxosFileName))
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, errors.Wrap(err, "loadUnspentTxOuts-ReadFile")
+	}
+
+	var snapshot utxoSnapshot
+	if err := json.Unmarshal(bytes, &snapshot); err != nil {
+		return "", nil, errors.Wrap(err, "loadUnspentTxOuts-Unmarshal")
+	}
+
+	if snapshot.Version != utxoSnapshotVersion {
+		return "", nil, errors.Errorf("unspent transaction outputs are stored in version %d, expected %d", snapshot.Version, utxoSnapshotVersion)
+	}
+
+	return snapshot.BestHash, snapshot.UnspentTxOuts, nil
+}
@@ -10,6 +10,15 @@ import (
 	"golang.org/x/net/websocket"
 	"github.com/go-naivecoin/tx"
 	"github.com/go-naivecoin/wallet"
+	"flag"
+	"strconv"
+	"github.com/go-naivecoin/params"
+	"time"
+	"runtime"
+	"github.com/go-naivecoin/miner"
+	"github.com/go-naivecoin/stratum"
+	"fmt"
+	"github.com/pkg/errors"
 )
 
 type BlockRequest struct {
@@ -20,12 +29,64 @@ type PeerRequest struct {
 	Url string `json`
 }
 
+type MinerRequest struct {
+	Address string `json:"address"`
+	Threads int    `json:"threads"`
+}
+
+type GenerateRequest struct {
+	Address string `json:"address"`
+	Count   int    `json:"count"`
+}
+
+type MockTimeRequest struct {
+	Time int64 `json:"time"`
+}
+
 type TransactionRequest struct {
 	Address string `json:"address"`
 	Amount  int64  `json:"amount"`
+	Fee     int64  `json:"fee"`
+}
+
+type SignTransactionRequest struct {
+	Transaction tx.Transaction `json:"transaction"`
+	SigHashType string         `json:"sigHashType"`
+}
+
+type MultisigAddressRequest struct {
+	Required   int      `json:"required"`
+	PublicKeys []string `json:"publicKeys"`
+}
+
+type MultisigSpendRequest struct {
+	From    string `json:"from"`
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+	Fee     int64  `json:"fee"`
+}
+
+var stratumServer *stratum.Server
+
+// errorResponse reports err along with the validation error of package block
+// or tx it wraps, as reason, for clients to tell rejections apart.
+func errorResponse(err error) gin.H {
+	return gin.H{
+		"error":  err.Error(),
+		"reason": errors.Cause(err).Error(),
+	}
 }
 
 func main() {
+	dataDir := flag.String("datadir", "", "directory to store the blockchain in, kept in memory if empty")
+	addressIndex := flag.Bool("addrindex", false, "keep the history of every address for /address/:address/transactions")
+	network := flag.String("network", "mainnet", "network to run on: mainnet, testnet or regtest")
+	chainParamsFile := flag.String("chainparams", "", "json file with custom chain parameters, overrides -network")
+	stratumAddr := flag.String("stratum", "", "address to serve stratum mining on, e.g. :3333, disabled if empty")
+	stratumDifficulty := flag.Int("stratumdifficulty", 16, "leading zero bits of the shares stratum workers submit")
+	minerThreads := flag.Int("minerthreads", runtime.NumCPU(), "number of goroutines searching for a nonce when mining")
+	flag.Parse()
+
 	r := gin.Default()
 
 	r.GET("/blocks", func(c *gin.Context) {
@@ -38,12 +99,25 @@ func main() {
 
 		//hash := "91a73664bc84c0baa1fc75ea6e4aa6d1d20c5df664c724e3159aefc2e1186627"
 
-		blockChain := block.GetBlockchain()
+		block, found := block.GetBlockByHash(hash)
 
-		block, found := From(blockChain).FirstWith(func(i interface{}) bool {
-			block := i.(block.Block)
-			return block.Hash == hash
-		}).(block.Block)
+		if found {
+			c.JSON(http.StatusOK, block)
+		} else {
+			c.JSON(http.StatusOK, gin.H{
+				"block": "Not found",
+			})
+		}
+	})
+
+	r.GET("/blockAtHeight/:height", func(c *gin.Context) {
+		height, err := strconv.ParseInt(c.Param("height"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		block, found := block.GetBlockByHeight(height)
 
 		if found {
 			c.JSON(http.StatusOK, block)
@@ -54,18 +128,29 @@ func main() {
 		}
 	})
 
+	r.GET("/chainTips", func(c *gin.Context) {
+		c.JSON(http.StatusOK, block.GetChainTips())
+	})
+
+	r.GET("/supply", func(c *gin.Context) {
+		c.JSON(http.StatusOK, block.GetSupply())
+	})
+
+	r.GET("/miningInfo", func(c *gin.Context) {
+		bits := block.GetNextBits()
+		c.JSON(http.StatusOK, gin.H{
+			"hashRate":   block.GetHashRate(),
+			"threads":    block.GetMinerThreads(),
+			"bits":       fmt.Sprintf("%08x", bits),
+			"difficulty": block.GetDifficulty(bits),
+			"medianTime": block.GetMedianTimePast(),
+		})
+	})
+
 	r.GET("/transaction/:id", func(c *gin.Context) {
 		id := c.Param("id")
 
-		blockChain := block.GetBlockchain()
-
-		transaction, found := From(blockChain).SelectMany(func(i interface{}) Query {
-			block := i.(block.Block)
-			return From(block.Data)
-		}).FirstWith(func(i interface{}) bool {
-			tx := i.(tx.Transaction)
-			return tx.Id == id
-		}).(tx.Transaction)
+		transaction, found := block.GetTransaction(id)
 
 		if found {
 			c.JSON(http.StatusOK, transaction)
@@ -76,6 +161,39 @@ func main() {
 		}
 	})
 
+	r.GET("/transaction/:id/location", func(c *gin.Context) {
+		id := c.Param("id")
+
+		location, found := block.GetTransactionLocation(id)
+
+		if found {
+			c.JSON(http.StatusOK, location)
+		} else {
+			c.JSON(http.StatusOK, gin.H{
+				"transaction": "Not found",
+			})
+		}
+	})
+
+	r.GET("/transaction/:id/proof", func(c *gin.Context) {
+		id := c.Param("id")
+
+		proof, block, found := block.GetTransactionProof(id)
+
+		if found {
+			c.JSON(http.StatusOK, gin.H{
+				"blockHash":  block.Hash,
+				"blockIndex": block.Index,
+				"merkleRoot": block.MerkleRoot,
+				"proof":      proof,
+			})
+		} else {
+			c.JSON(http.StatusOK, gin.H{
+				"transaction": "Not found",
+			})
+		}
+	})
+
 	r.GET("/address/:address", func(c *gin.Context) {
 		address := c.Param("address")
 
@@ -93,6 +211,38 @@ func main() {
 		})
 	})
 
+	r.GET("/address/:address/transactions", func(c *gin.Context) {
+		if !block.IsAddressIndexEnabled() {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "address index is disabled, start the node with -addrindex",
+			})
+			return
+		}
+
+		address := c.Param("address")
+
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+
+		txOuts, total := block.GetAddressHistory(address, offset, limit)
+
+		c.JSON(http.StatusOK, gin.H{
+			"total":  total,
+			"offset": offset,
+			"limit":  limit,
+			"txOuts": txOuts,
+		})
+	})
+
 	r.GET("/unspentTransactionOutputs", func(c *gin.Context) {
 		utxos := block.GetUnpentTxOuts()
 
@@ -112,13 +262,11 @@ func main() {
 			return
 		}
 
-		nextBlock := block.GenerateRawBlock(blockRequest.Transactions)
+		nextBlock, err := block.GenerateRawBlock(blockRequest.Transactions)
 		p2p.BroadcastLatest()
 
-		if nextBlock == nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "could not generate block",
-			})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err))
 		} else {
 			c.JSON(http.StatusOK, *nextBlock)
 		}
@@ -137,15 +285,150 @@ func main() {
 		}
 	})
 
+	r.GET("/blockTemplate", func(c *gin.Context) {
+		address := c.Query("address")
+		if address == "" {
+			walletAddress, err := wallet.GetPublicFromWallet()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			address = walletAddress
+		}
+
+		template, err := block.GetBlockTemplate(address)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, template)
+	})
+
+	r.POST("/submitBlock", func(c *gin.Context) {
+		var newBlock block.Block
+
+		if err := c.ShouldBindJSON(&newBlock); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := block.SubmitBlock(newBlock); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err))
+			return
+		}
+
+		// a block kept on a side branch leaves the tip to broadcast unchanged
+		if block.GetLatestBlock().Hash == newBlock.Hash {
+			p2p.BroadcastLatest()
+		}
+		c.JSON(http.StatusOK, newBlock)
+	})
+
+	r.GET("/stratum/workers", func(c *gin.Context) {
+		if stratumServer == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "stratum server is not running"})
+			return
+		}
+
+		c.JSON(http.StatusOK, stratumServer.Workers())
+	})
+
+	r.POST("/miner/start", func(c *gin.Context) {
+		var minerRequest MinerRequest
+
+		// the body is optional, the miner pays to the wallet by default
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&minerRequest); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if err := miner.Start(minerRequest.Address, minerRequest.Threads); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, miner.GetStatus())
+	})
+
+	r.POST("/miner/stop", func(c *gin.Context) {
+		miner.Stop()
+		c.JSON(http.StatusOK, miner.GetStatus())
+	})
+
+	r.GET("/miner/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, miner.GetStatus())
+	})
+
+	r.POST("/generate", func(c *gin.Context) {
+		var generateRequest GenerateRequest
+
+		if err := c.ShouldBindJSON(&generateRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		blocks, err := block.GenerateBlocks(generateRequest.Address, generateRequest.Count)
+		if len(blocks) > 0 {
+			p2p.BroadcastLatest()
+		}
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusOK, blocks)
+		}
+	})
+
+	r.GET("/networkTime", func(c *gin.Context) {
+		offset, samples := block.GetTimeOffset()
+		c.JSON(http.StatusOK, gin.H{
+			"localTime":    block.Now().Unix(),
+			"adjustedTime": block.AdjustedNow().Unix(),
+			"offset":       offset,
+			"samples":      samples,
+		})
+	})
+
+	r.POST("/setMockTime", func(c *gin.Context) {
+		var mockTimeRequest MockTimeRequest
+
+		if err := c.ShouldBindJSON(&mockTimeRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !params.Active().RegTest {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mock time is only allowed on regtest networks"})
+			return
+		}
+
+		if mockTimeRequest.Time == 0 {
+			block.SetClock(nil)
+		} else {
+			mockTime := time.Unix(mockTimeRequest.Time, 0)
+			block.SetClock(func() time.Time {
+				return mockTime
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"time": block.Now().Unix(),
+		})
+	})
+
 	r.GET("/balance", func(c *gin.Context) {
-		balance, err := block.GetAccountBalance()
+		balance, immature, err := block.GetAccountBalance()
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"error": err.Error(),
 			})
 		} else {
 			c.JSON(http.StatusOK, gin.H{
-				"balance": balance,
+				"balance":  balance,
+				"immature": immature,
 			})
 		}
 	})
@@ -157,8 +440,10 @@ func main() {
 				"error": err.Error(),
 			})
 		} else {
+			pubKeyHashAddress, _ := tx.PayToPubKeyHashAddress(address)
 			c.JSON(http.StatusOK, gin.H{
-				"address": address,
+				"address":           address,
+				"pubKeyHashAddress": pubKeyHashAddress,
 			})
 		}
 	})
@@ -174,7 +459,7 @@ func main() {
 		block, err := block.GenerateNextBlockWithTransation(transactionRequest.Address, transactionRequest.Amount)
 
 		if err != nil {
-			c.JSON(http.StatusBadRequest, err.Error())
+			c.JSON(http.StatusBadRequest, errorResponse(err))
 		} else {
 			c.JSON(http.StatusOK, *block)
 		}
@@ -188,16 +473,129 @@ func main() {
 			return
 		}
 
-		transaction, err := block.SendTransaction(transactionRequest.Address, transactionRequest.Amount)
+		transaction, err := block.SendTransaction(transactionRequest.Address, transactionRequest.Amount, transactionRequest.Fee)
 
 		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err))
+		} else {
 			p2p.BroadCastTransactionPool()
-			c.JSON(http.StatusBadRequest, err.Error())
+			c.JSON(http.StatusOK, *transaction)
+		}
+	})
+
+	r.POST("/signTransaction", func(c *gin.Context) {
+		var signRequest SignTransactionRequest
+
+		if err := c.ShouldBindJSON(&signRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		hashType, err := tx.ParseSigHashType(signRequest.SigHashType)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		transaction := signRequest.Transaction
+		signed, err := block.SignTransaction(&transaction, hashType)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err))
+		} else {
+			c.JSON(http.StatusOK, gin.H{"transaction": transaction, "signed": signed})
+		}
+	})
+
+	r.POST("/multisigAddress", func(c *gin.Context) {
+		var addressRequest MultisigAddressRequest
+
+		if err := c.ShouldBindJSON(&addressRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		address, err := wallet.CreateMultisigAddress(addressRequest.Required, addressRequest.PublicKeys)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusOK, gin.H{"address": address})
+		}
+	})
+
+	r.POST("/multisigSpend", func(c *gin.Context) {
+		var spendRequest MultisigSpendRequest
+
+		if err := c.ShouldBindJSON(&spendRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		transaction, err := block.CreateMultisigSpend(spendRequest.From, spendRequest.Address, spendRequest.Amount, spendRequest.Fee)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err))
 		} else {
 			c.JSON(http.StatusOK, *transaction)
 		}
 	})
 
+	r.POST("/cosignTransaction", func(c *gin.Context) {
+		var signRequest SignTransactionRequest
+
+		if err := c.ShouldBindJSON(&signRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		hashType, err := tx.ParseSigHashType(signRequest.SigHashType)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		transaction := signRequest.Transaction
+		signed, err := block.CosignTransaction(&transaction, hashType)
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err))
+		} else {
+			c.JSON(http.StatusOK, gin.H{"transaction": transaction, "signed": signed})
+		}
+	})
+
+	r.POST("/finalizeTransaction", func(c *gin.Context) {
+		var transaction tx.Transaction
+
+		if err := c.ShouldBindJSON(&transaction); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := block.FinalizeTransaction(&transaction); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err))
+		} else {
+			c.JSON(http.StatusOK, transaction)
+		}
+	})
+
+	r.POST("/sendRawTransaction", func(c *gin.Context) {
+		var transaction tx.Transaction
+
+		if err := c.ShouldBindJSON(&transaction); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := block.HandleReceivedTransaction(&transaction); err != nil {
+			c.JSON(http.StatusBadRequest, errorResponse(err))
+		} else {
+			p2p.BroadCastTransactionPool()
+			c.JSON(http.StatusOK, transaction)
+		}
+	})
+
 	r.GET("/transactionPool", func(c *gin.Context) {
 		txPool := tx.GetTransactionPool()
 		c.JSON(http.StatusOK, txPool)
@@ -248,6 +646,40 @@ func main() {
 		})
 	})
 
+	chainParams, err := params.Get(*network)
+	if *chainParamsFile != "" {
+		chainParams, err = params.LoadFromFile(*chainParamsFile)
+	}
+	if err != nil {
+		log.Fatal("chain params: ", err)
+	}
+
+	params.SetActive(chainParams)
+	log.Printf("running on %s", chainParams.Name)
+
+	block.SetMinerThreads(*minerThreads)
+
+	if err := block.InitBlockStore(*dataDir); err != nil {
+		log.Fatal("init block store: ", err)
+	}
+
+	if *addressIndex {
+		block.EnableAddressIndex()
+	}
+
 	wallet.InitWallet()
+
+	if *stratumAddr != "" {
+		address, err := wallet.GetPublicFromWallet()
+		if err != nil {
+			log.Fatal("stratum payout address: ", err)
+		}
+
+		stratumServer = stratum.NewServer(address, *stratumDifficulty)
+		if err := stratumServer.Listen(*stratumAddr); err != nil {
+			log.Fatal("stratum: ", err)
+		}
+	}
+
 	r.Run() // listen and serve on 0.0.0.0:8080
 }
@@ -0,0 +1,132 @@
+package miner
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-naivecoin/block"
+	"github.com/go-naivecoin/p2p"
+	"github.com/go-naivecoin/tx"
+	"github.com/go-naivecoin/wallet"
+	"github.com/pkg/errors"
+)
+
+// retryDelay is how long the miner waits before trying again after a block
+// could not be mined, so that a bad transaction pool does not make it spin.
+const retryDelay = time.Second
+
+// Status describes the background miner for /miner/status.
+type Status struct {
+	Running     bool    `json:"running"`
+	Address     string  `json:"address"`
+	Threads     int     `json:"threads"`
+	HashRate    float64 `json:"hashRate"`
+	BlocksMined int     `json:"blocksMined"`
+	LastBlock   string  `json:"lastBlock"`
+}
+
+var mutex sync.Mutex
+var cancel context.CancelFunc
+var done chan struct{}
+var status Status
+
+// Start keeps mining blocks on top of the current tip in the background,
+// paying their coinbase to address, the wallet address when empty. A
+// positive threads sets how many goroutines search for a nonce.
+func Start(address string, threads int) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if cancel != nil {
+		return errors.New("miner is already running")
+	}
+
+	if address == "" {
+		walletAddress, err := wallet.GetPublicFromWallet()
+		if err != nil {
+			return errors.Wrap(err, "Start-GetPublicFromWallet")
+		}
+		address = walletAddress
+	}
+
+	if !tx.IsValidAddress(address) {
+		return errors.New("Invalid address")
+	}
+
+	if threads > 0 {
+		block.SetMinerThreads(threads)
+	}
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	done = make(chan struct{})
+	status = Status{Running: true, Address: address}
+
+	go run(ctx, address, done)
+
+	log.Printf("miner started with %d threads, paying to %s", block.GetMinerThreads(), address)
+	return nil
+}
+
+// Stop stops the background miner and waits for it to finish.
+func Stop() {
+	mutex.Lock()
+	if cancel == nil {
+		mutex.Unlock()
+		return
+	}
+
+	cancel()
+	stopped := done
+	cancel = nil
+	mutex.Unlock()
+
+	// the miner takes the lock to record the blocks it mines
+	<-stopped
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	status.Running = false
+	log.Printf("miner stopped after %d blocks", status.BlocksMined)
+}
+
+func GetStatus() Status {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current := status
+	current.Threads = block.GetMinerThreads()
+	current.HashRate = block.GetHashRate()
+	return current
+}
+
+func run(ctx context.Context, address string, done chan struct{}) {
+	defer close(done)
+
+	for {
+		newBlock, err := block.MineNextBlock(ctx, address)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Printf("miner could not mine a block: %s", err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+
+		p2p.BroadcastLatest()
+
+		mutex.Lock()
+		status.BlocksMined++
+		status.LastBlock = newBlock.Hash
+		mutex.Unlock()
+	}
+}
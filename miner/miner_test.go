@@ -0,0 +1,48 @@
+package miner_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-naivecoin/block"
+	"github.com/go-naivecoin/miner"
+	"github.com/go-naivecoin/params"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	ADDRESS = "04115c42e757b2efb7671c578530ec191a1359381e6a71127a9d37c486fd30dae57e76dc58f693bd7e7010358ce6b165e483a2921010db67ac11b1b51b651953d2"
+)
+
+func TestStart_ThenMinesUntilStopped(t *testing.T) {
+	params.SetActive(&params.RegTestParams)
+	defer func() {
+		params.SetActive(&params.MainNetParams)
+		block.InitBlockStore("")
+	}()
+	assert.Nil(t, block.InitBlockStore(""))
+
+	assert.Nil(t, miner.Start(ADDRESS, 2))
+	assert.NotNil(t, miner.Start(ADDRESS, 2))
+
+	for i := 0; i < 100 && miner.GetStatus().BlocksMined < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	miner.Stop()
+
+	status := miner.GetStatus()
+	assert.False(t, status.Running)
+	assert.Equal(t, ADDRESS, status.Address)
+	assert.Equal(t, 2, status.Threads)
+	assert.True(t, status.BlocksMined >= 3)
+
+	height := block.GetLatestBlock().Index
+	assert.True(t, height >= int64(status.BlocksMined))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, height, block.GetLatestBlock().Index)
+}
+
+func TestStart_InvalidAddress(t *testing.T) {
+	assert.NotNil(t, miner.Start("invalid", 1))
+	assert.False(t, miner.GetStatus().Running)
+}
@@ -5,14 +5,22 @@ import (
 	. "github.com/ahmetb/go-linq"
 	"github.com/go-naivecoin/block"
 	"log"
+	"net"
 	"net/url"
+	"sync"
 	"encoding/json"
 	"time"
 	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
 )
 
 var sockets [] *websocket.Conn
 
+// timeSampled holds the connections whose handshake was taken as a time
+// sample, by the host they sampled.
+var timeSampled = make(map[*websocket.Conn]string)
+var timeSampledMutex sync.Mutex
+
 type MessageType int
 
 const (
@@ -21,6 +29,8 @@ const (
 	RESPONSE_BLOCKCHAIN       MessageType = 2
 	QUERY_TRANSACTION_POOL    MessageType = 3
 	RESPONSE_TRANSACTION_POOL MessageType = 4
+	HANDSHAKE                 MessageType = 5
+	REJECT                    MessageType = 6
 )
 
 type P2PMessage struct {
@@ -28,6 +38,21 @@ type P2PMessage struct {
 	Data string      `json:"data"`
 }
 
+// Handshake is the first message both sides of a connection send, it
+// reports the clock of the sender to adjust the network time.
+type Handshake struct {
+	Time int64 `json:"time"`
+}
+
+// Reject tells a peer why a block or transaction it sent was rejected.
+// Reason is the validation error of package block or tx it was rejected
+// with, Error adds the details.
+type Reject struct {
+	Hash   string `json:"hash"`
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
 var Wsupgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -60,6 +85,15 @@ func InitConnection(conn *websocket.Conn) {
 			log.Printf("Received message: %v", message)
 
 			switch message.Type {
+			case HANDSHAKE:
+				var handshake Handshake
+				if err := json.Unmarshal([]byte(message.Data), &handshake); err != nil {
+					log.Printf("invalid handshake receive, %s", message.Data)
+					break
+				}
+
+				addTimeSample(conn, handshake.Time-block.Now().Unix())
+				break
 			case QUERY_LATEST:
 				write(responseLatestMsg(), conn)
 				break
@@ -75,7 +109,7 @@ func InitConnection(conn *websocket.Conn) {
 					break
 				}
 
-				handleReceivedResponse(receivedBlocks)
+				handleReceivedResponse(receivedBlocks, conn)
 				break
 			case QUERY_TRANSACTION_POOL:
 				write(responseTransactionPoolMsg(), conn)
@@ -90,15 +124,28 @@ func InitConnection(conn *websocket.Conn) {
 				}
 
 				for _, transaction := range receivedTransactions {
-					block.HandleReceivedTransaction(&transaction)
+					if err := block.HandleReceivedTransaction(&transaction); err != nil {
+						rejectTo(conn, transaction.Id, err)
+						continue
+					}
 					BroadCastTransactionPool()
 				}
 
+				break
+			case REJECT:
+				var reject Reject
+				if err := json.Unmarshal([]byte(message.Data), &reject); err != nil {
+					log.Printf("invalid reject receive, %s", message.Data)
+					break
+				}
+
+				log.Printf("peer %s rejected %s: %s", conn.RemoteAddr().String(), reject.Hash, reject.Error)
 				break
 			}
 		}
 	}()
 
+	write(handshakeMsg(), conn)
 	write(queryChainLengthMsg(), conn)
 	time.AfterFunc(500*time.Millisecond, func() {
 		write(queryTransactionPoolMsg(), conn)
@@ -114,10 +161,43 @@ func closeConnection(s *websocket.Conn) {
 	}).ToSlice(&newSockets)
 
 	s.Close()
+	removeTimeSample(s)
 
 	sockets = newSockets
 }
 
+// addTimeSample samples the clock of the peer at conn from its first
+// handshake. Samples are by IP address, so that a host opening several
+// connections does not get several votes on the network time.
+func addTimeSample(conn *websocket.Conn, offset int64) {
+	host := conn.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	timeSampledMutex.Lock()
+	defer timeSampledMutex.Unlock()
+
+	if _, sampled := timeSampled[conn]; sampled {
+		log.Printf("ignoring repeated handshake of peer %s", conn.RemoteAddr().String())
+		return
+	}
+
+	log.Printf("peer %s clock is %d seconds off ours", conn.RemoteAddr().String(), offset)
+	timeSampled[conn] = host
+	block.AddTimeSample(host, offset)
+}
+
+func removeTimeSample(conn *websocket.Conn) {
+	timeSampledMutex.Lock()
+	defer timeSampledMutex.Unlock()
+
+	if host, sampled := timeSampled[conn]; sampled {
+		delete(timeSampled, conn)
+		block.RemoveTimeSample(host)
+	}
+}
+
 func Broadcast(message P2PMessage) {
 	From(sockets).ForEach(func(i interface{}) {
 		socket := i.(*websocket.Conn)
@@ -133,6 +213,11 @@ func write(message P2PMessage, conn *websocket.Conn) {
 	}
 }
 
+func handshakeMsg() P2PMessage {
+	bytes, _ := json.Marshal(Handshake{Time: block.Now().Unix()})
+	return P2PMessage{Type: HANDSHAKE, Data: string(bytes)}
+}
+
 func queryChainLengthMsg() P2PMessage {
 	return P2PMessage{Type: QUERY_LATEST, Data: ""}
 }
@@ -170,7 +255,19 @@ func responseLatestMsg() P2PMessage {
 	return P2PMessage{Type: RESPONSE_BLOCKCHAIN, Data: string(bytes)}
 }
 
-func handleReceivedResponse(receivedBlocks []block.Block) {
+// rejectTo tells the peer why what it sent was rejected, unless it was
+// merely known already.
+func rejectTo(conn *websocket.Conn, hash string, err error) {
+	if cause := errors.Cause(err); cause == block.ErrKnownBlock || cause == tx.ErrKnownTransaction {
+		return
+	}
+
+	log.Printf("rejecting %s: %s", hash, err.Error())
+	bytes, _ := json.Marshal(Reject{Hash: hash, Reason: errors.Cause(err).Error(), Error: err.Error()})
+	write(P2PMessage{Type: REJECT, Data: string(bytes)}, conn)
+}
+
+func handleReceivedResponse(receivedBlocks []block.Block, conn *websocket.Conn) {
 	if len(receivedBlocks) == 0 {
 		log.Print("received block chain size of 0")
 		return
@@ -179,22 +276,32 @@ func handleReceivedResponse(receivedBlocks []block.Block) {
 	latestReceivedBlock := From(receivedBlocks).Last().(block.Block)
 	latestBlockHeld := block.GetLatestBlock()
 
-	if latestReceivedBlock.Index > latestBlockHeld.Index {
-		log.Printf("blockchian possibly behind. We got: %d Peer got: %d", latestBlockHeld.Index, latestReceivedBlock.Index)
+	if block.HasBlock(latestReceivedBlock.Hash) {
+		log.Print("received block is already known. Do nothing")
+		return
+	}
+
+	log.Printf("received block %s at index %d, our tip is at index %d", latestReceivedBlock.Hash, latestReceivedBlock.Index, latestBlockHeld.Index)
 
-		if latestBlockHeld.Hash == latestReceivedBlock.PreviousHash {
-			if block.AddBlockToChain(latestReceivedBlock) {
-				Broadcast(responseLatestMsg())
+	if len(receivedBlocks) == 1 {
+		if block.HasBlock(latestReceivedBlock.PreviousHash) {
+			if err := block.AddBlockToChain(latestReceivedBlock); err != nil {
+				rejectTo(conn, latestReceivedBlock.Hash, err)
 			}
-		} else if len(receivedBlocks) == 1 {
+		} else {
 			log.Print("We have to query the chain from our peer")
 			Broadcast(queryAllMsg())
-		} else {
-			log.Print("Received blockchain is longer than current blockchain")
-			block.ReplaceChain(receivedBlocks)
+			return
 		}
 	} else {
-		log.Print("received blockchain is not longer than received blockchain. Do nothing")
+		log.Print("Received blockchain, adding its blocks to the block tree")
+		if err := block.ReplaceChain(receivedBlocks); err != nil {
+			rejectTo(conn, latestReceivedBlock.Hash, err)
+		}
+	}
+
+	if block.GetLatestBlock().Hash != latestBlockHeld.Hash {
+		Broadcast(responseLatestMsg())
 	}
 }
 
@@ -0,0 +1,270 @@
+package params
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// Difficulty algorithms, see block.NewDifficultyAlgorithm.
+const (
+	DIFFICULTY_INTERVAL = "interval"
+	DIFFICULTY_LWMA     = "lwma"
+	DIFFICULTY_ASERT    = "asert"
+)
+
+// MAX_MONEY bounds every amount and every sum of amounts, far above the
+// supply of any chain, so that adding them never overflows. The coinbase
+// amount of a chain must stay below it.
+const MAX_MONEY int64 = 21000000 * 100000000
+
+// ChainParams holds the consensus rules of a network and what its genesis
+// block is built from.
+type ChainParams struct {
+	Name string `json:"name"`
+
+	GenesisAddress   string `json:"genesisAddress"`
+	GenesisTimestamp int64  `json:"genesisTimestamp"`
+	// GenesisBits is the target of the genesis block in compact form.
+	GenesisBits  uint32 `json:"genesisBits"`
+	GenesisNonce int64  `json:"genesisNonce"`
+	// GenesisHash pins the hash of the genesis block calculated from the
+	// fields above, the node refuses to start when they differ. Empty does
+	// not pin it.
+	GenesisHash string `json:"genesisHash"`
+
+	BlockGenerationInterval      int `json:"blockGenerationInterval"`
+	DifficultyAdjustmentInterval int `json:"difficultyAdjustmentInterval"`
+	// PowLimitBits is the easiest target, in compact form, retargeting may
+	// reach.
+	PowLimitBits uint32 `json:"powLimitBits"`
+	// DifficultyAlgorithm is interval, the default, lwma or asert.
+	DifficultyAlgorithm string `json:"difficultyAlgorithm"`
+	// DifficultyWindow is how many blocks lwma averages over.
+	DifficultyWindow int `json:"difficultyWindow"`
+	// DifficultyHalfLife is how many seconds behind or ahead of schedule
+	// make asert halve or double the work.
+	DifficultyHalfLife int64 `json:"difficultyHalfLife"`
+	// CoinbaseAmount is the block subsidy until the first halving.
+	CoinbaseAmount int64 `json:"coinbaseAmount"`
+	// HalvingInterval is how many blocks pass between two halvings of the
+	// subsidy, it never halves when 0.
+	HalvingInterval int64 `json:"halvingInterval"`
+	// TailEmission is the floor the subsidy never halves below. The total
+	// supply is only capped without it.
+	TailEmission int64 `json:"tailEmission"`
+	// CoinbaseMaturity is how many blocks later coinbase outputs may be
+	// spent, so that a reorganisation dropping them cannot invalidate
+	// the transactions that spent them.
+	CoinbaseMaturity int64 `json:"coinbaseMaturity"`
+	// MaxFutureBlockTime is how far, in seconds, a block timestamp may lie
+	// after the network-adjusted time.
+	MaxFutureBlockTime int64 `json:"maxFutureBlockTime"`
+
+	// NoRetargeting keeps every block at the genesis difficulty.
+	NoRetargeting bool `json:"noRetargeting"`
+	// RegTest allows mining blocks on demand and setting the node clock,
+	// for tests against a deterministic chain.
+	RegTest bool `json:"regTest"`
+}
+
+var MainNetParams = ChainParams{
+	Name:                         "mainnet",
+	GenesisAddress:               "04bfcab8722991ae774db48f934ca79cfb7dd991229153b9f732ba5334aafcd8e7266e47076996b55a14bf9913ee3145ce0cfc1372ada8ada74bd287450313534a",
+	GenesisTimestamp:             1465154705,
+	GenesisBits:                  0x207fffff,
+	GenesisNonce:                 0,
+	GenesisHash:                  "027d3514e0287c21a856adbcdd29abaaf25642fa36eb49f9f57c7f50dc864c46",
+	BlockGenerationInterval:      10,
+	DifficultyAdjustmentInterval: 10,
+	PowLimitBits:                 0x207fffff,
+	CoinbaseAmount:               50,
+	HalvingInterval:              210000,
+	CoinbaseMaturity:             100,
+	MaxFutureBlockTime:           2 * 60 * 60,
+}
+
+var TestNetParams = ChainParams{
+	Name:                         "testnet",
+	GenesisAddress:               MainNetParams.GenesisAddress,
+	GenesisTimestamp:             1535760000,
+	GenesisBits:                  0x207fffff,
+	GenesisNonce:                 0,
+	BlockGenerationInterval:      10,
+	DifficultyAdjustmentInterval: 10,
+	PowLimitBits:                 0x207fffff,
+	CoinbaseAmount:               50,
+	HalvingInterval:              210000,
+	CoinbaseMaturity:             100,
+	MaxFutureBlockTime:           2 * 60 * 60,
+}
+
+var RegTestParams = ChainParams{
+	Name:                         "regtest",
+	GenesisAddress:               MainNetParams.GenesisAddress,
+	GenesisTimestamp:             1535760000,
+	GenesisBits:                  0x207fffff,
+	GenesisNonce:                 0,
+	BlockGenerationInterval:      10,
+	DifficultyAdjustmentInterval: 10,
+	PowLimitBits:                 0x207fffff,
+	CoinbaseAmount:               50,
+	HalvingInterval:              150,
+	CoinbaseMaturity:             100,
+	MaxFutureBlockTime:           2 * 60 * 60,
+	NoRetargeting:                true,
+	RegTest:                      true,
+}
+
+var networks = map[string]*ChainParams{
+	MainNetParams.Name: &MainNetParams,
+	TestNetParams.Name: &TestNetParams,
+	RegTestParams.Name: &RegTestParams,
+}
+
+var active = &MainNetParams
+
+// Active returns the parameters of the network the node runs on.
+func Active() *ChainParams {
+	return active
+}
+
+// SetActive selects the network the node runs on. It must be called before
+// the blockchain is initialised.
+func SetActive(chainParams *ChainParams) {
+	active = chainParams
+}
+
+// Get returns the preset parameters of a named network.
+func Get(name string) (*ChainParams, error) {
+	chainParams, found := networks[name]
+	if !found {
+		return nil, errors.Errorf("unknown network %s", name)
+	}
+
+	return chainParams, nil
+}
+
+// LoadFromFile reads custom chain parameters from a json file.
+func LoadFromFile(path string) (*ChainParams, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadFromFile-ReadFile")
+	}
+
+	var chainParams ChainParams
+	if err := json.Unmarshal(bytes, &chainParams); err != nil {
+		return nil, errors.Wrap(err, "LoadFromFile-Unmarshal")
+	}
+
+	if err := chainParams.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &chainParams, nil
+}
+
+func (p *ChainParams) Validate() error {
+	if p.Name == "" {
+		return errors.New("chain params need a name")
+	} else if p.GenesisAddress == "" {
+		return errors.New("chain params need a genesis address")
+	} else if p.BlockGenerationInterval <= 0 || p.DifficultyAdjustmentInterval <= 0 {
+		return errors.New("block generation and difficulty adjustment intervals must be positive")
+	} else if p.GenesisBits == 0 || p.PowLimitBits == 0 {
+		return errors.New("chain params need genesis bits and a proof of work limit")
+	}
+
+	switch p.DifficultyAlgorithm {
+	case "", DIFFICULTY_INTERVAL:
+	case DIFFICULTY_LWMA:
+		if p.DifficultyWindow <= 0 {
+			return errors.New("lwma needs a positive difficulty window")
+		}
+	case DIFFICULTY_ASERT:
+		if p.DifficultyHalfLife <= 0 {
+			return errors.New("asert needs a positive difficulty half life")
+		}
+	default:
+		return errors.Errorf("unknown difficulty algorithm %s", p.DifficultyAlgorithm)
+	}
+
+	if p.CoinbaseAmount <= 0 || p.CoinbaseAmount > MAX_MONEY {
+		return errors.Errorf("coinbase amount must be between 1 and %d", MAX_MONEY)
+	} else if p.HalvingInterval < 0 {
+		return errors.New("halving interval must not be negative")
+	} else if p.TailEmission < 0 || p.TailEmission > p.CoinbaseAmount {
+		return errors.New("tail emission must be between 0 and the coinbase amount")
+	} else if p.CoinbaseMaturity < 0 {
+		return errors.New("coinbase maturity must not be negative")
+	} else if p.MaxFutureBlockTime < 0 {
+		return errors.New("max future block time must not be negative")
+	}
+
+	return nil
+}
+
+// BlockSubsidy returns the coins created by the coinbase of the block at
+// height, on top of the fees of the block.
+func (p *ChainParams) BlockSubsidy(height int64) int64 {
+	subsidy := p.CoinbaseAmount
+	if p.HalvingInterval > 0 {
+		halvings := uint64(height / p.HalvingInterval)
+		if halvings >= 63 {
+			subsidy = 0
+		} else {
+			subsidy >>= halvings
+		}
+	}
+
+	if subsidy < p.TailEmission {
+		return p.TailEmission
+	}
+	return subsidy
+}
+
+// ScheduledSupply returns the sum of the subsidies of the blocks up to and
+// including height, the genesis block included.
+func (p *ChainParams) ScheduledSupply(height int64) int64 {
+	if height < 0 {
+		return 0
+	}
+
+	if p.HalvingInterval == 0 {
+		return (height + 1) * p.BlockSubsidy(0)
+	}
+
+	var supply int64
+	for start := int64(0); start <= height; start += p.HalvingInterval {
+		subsidy := p.BlockSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+
+		end := start + p.HalvingInterval - 1
+		if end > height || subsidy == p.TailEmission {
+			// the subsidy no longer changes once it reaches the tail emission
+			end = height
+		}
+
+		supply += (end - start + 1) * subsidy
+		if end == height {
+			break
+		}
+	}
+
+	return supply
+}
+
+// MaxSupply returns the supply once the subsidy has halved down to nothing,
+// and false when the subsidy never ends.
+func (p *ChainParams) MaxSupply() (int64, bool) {
+	if p.HalvingInterval == 0 || p.TailEmission > 0 {
+		return 0, false
+	}
+
+	halvings := int64(bits.Len64(uint64(p.CoinbaseAmount)))
+	return p.ScheduledSupply(halvings * p.HalvingInterval), true
+}
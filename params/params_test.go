@@ -0,0 +1,71 @@
+package params_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-naivecoin/params"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet_UnknownNetwork(t *testing.T) {
+	_, err := params.Get("nonet")
+
+	assert.NotNil(t, err)
+}
+
+func TestLoadFromFile(t *testing.T) {
+	custom := params.TestNetParams
+	custom.Name = "private"
+	custom.CoinbaseAmount = 25
+
+	file, err := ioutil.TempFile("", "chainparams")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+
+	json.NewEncoder(file).Encode(custom)
+	file.Close()
+
+	loaded, err := params.LoadFromFile(file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, custom, *loaded)
+}
+
+func TestValidate_CoinbaseAmountAboveMaxMoney(t *testing.T) {
+	custom := params.TestNetParams
+	custom.CoinbaseAmount = params.MAX_MONEY
+	assert.Nil(t, custom.Validate())
+
+	custom.CoinbaseAmount = params.MAX_MONEY + 1
+	assert.NotNil(t, custom.Validate())
+}
+
+func TestBlockSubsidy_Halves(t *testing.T) {
+	chainParams := params.ChainParams{CoinbaseAmount: 50, HalvingInterval: 10}
+
+	assert.Equal(t, int64(50), chainParams.BlockSubsidy(0))
+	assert.Equal(t, int64(50), chainParams.BlockSubsidy(9))
+	assert.Equal(t, int64(25), chainParams.BlockSubsidy(10))
+	assert.Equal(t, int64(12), chainParams.BlockSubsidy(20))
+	assert.Equal(t, int64(0), chainParams.BlockSubsidy(60))
+	assert.Equal(t, int64(500+250+120), chainParams.ScheduledSupply(29))
+
+	maxSupply, capped := chainParams.MaxSupply()
+	assert.True(t, capped)
+	assert.Equal(t, int64(10*(50+25+12+6+3+1)), maxSupply)
+	assert.Equal(t, maxSupply, chainParams.ScheduledSupply(1000))
+}
+
+func TestBlockSubsidy_TailEmission(t *testing.T) {
+	chainParams := params.ChainParams{CoinbaseAmount: 50, HalvingInterval: 10, TailEmission: 5}
+
+	assert.Equal(t, int64(6), chainParams.BlockSubsidy(30))
+	assert.Equal(t, int64(5), chainParams.BlockSubsidy(40))
+	assert.Equal(t, int64(5), chainParams.BlockSubsidy(100000))
+	assert.Equal(t, int64(10*(50+25+12+6)+5*61), chainParams.ScheduledSupply(100))
+
+	_, capped := chainParams.MaxSupply()
+	assert.False(t, capped)
+}
@@ -0,0 +1,70 @@
+package stratum
+
+import (
+	"encoding/json"
+
+	"github.com/go-naivecoin/block"
+)
+
+// Methods of the protocol. Messages are json objects, one per line, in the
+// manner of Stratum: requests carry an id that their response echoes,
+// notifications pushed by the server have a null id.
+const (
+	METHOD_SUBSCRIBE = "mining.subscribe"
+	METHOD_SUBMIT    = "mining.submit"
+	METHOD_NOTIFY    = "mining.notify"
+)
+
+type Request struct {
+	Id     *int64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type Response struct {
+	Id     *int64      `json:"id"`
+	Result interface{} `json:"result"`
+	Error  *string     `json:"error"`
+}
+
+type Notification struct {
+	Id     *int64      `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+// SubscribeParams names the worker. Difficulty is the leading zero bits of
+// its shares, the server default when zero.
+type SubscribeParams struct {
+	Worker     string `json:"worker"`
+	Difficulty int    `json:"difficulty,omitempty"`
+}
+
+type SubscribeResult struct {
+	Worker     string `json:"worker"`
+	Difficulty int    `json:"difficulty"`
+}
+
+type SubmitParams struct {
+	JobId string `json:"jobId"`
+	Nonce int64  `json:"nonce"`
+}
+
+type SubmitResult struct {
+	Accepted bool   `json:"accepted"`
+	Block    string `json:"block,omitempty"`
+}
+
+// Job is the work pushed to a worker. A share is a nonce from NonceStart to
+// NonceEnd, excluded, whose block hash meets ShareBits, it is also a block
+// when the hash meets the target of the template. Every subscription gets its
+// own nonce range so that workers do not search the same hashes. CleanJobs
+// tells that shares for earlier jobs are no longer accepted.
+type Job struct {
+	Id string `json:"jobId"`
+	block.BlockTemplate
+	ShareBits  uint32 `json:"shareBits"`
+	NonceStart int64  `json:"nonceStart"`
+	NonceEnd   int64  `json:"nonceEnd"`
+	CleanJobs  bool   `json:"cleanJobs"`
+}
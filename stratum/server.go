@@ -0,0 +1,504 @@
+package stratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-naivecoin/block"
+	"github.com/go-naivecoin/p2p"
+	"github.com/pkg/errors"
+)
+
+const (
+	writeTimeout = 10 * time.Second
+
+	// nonceRangeBits is the size of the nonce range of a subscription.
+	nonceRangeBits = 40
+	nonceRanges    = 1 << (63 - nonceRangeBits)
+	maxDifficulty  = 255
+
+	// defaultRefreshInterval is how often the job is rebuilt to take in the
+	// transactions that reached the pool since the tip changed.
+	defaultRefreshInterval = 30 * time.Second
+	// maxTipJobs is how many jobs of the current tip still take shares.
+	maxTipJobs = 4
+	// maxJobShares bounds the shares a connection records for a job.
+	maxJobShares = 1 << 16
+	// maxRejectedShares is how many rejected shares in a row get a worker
+	// disconnected.
+	maxRejectedShares = 100
+)
+
+// WorkerStats is the share accounting of a worker, by worker name.
+type WorkerStats struct {
+	Name       string    `json:"name"`
+	Difficulty int       `json:"difficulty"`
+	Accepted   int       `json:"accepted"`
+	Rejected   int       `json:"rejected"`
+	Stale      int       `json:"stale"`
+	Blocks     int       `json:"blocks"`
+	LastShare  time.Time `json:"lastShare"`
+}
+
+// client is a worker connection. Its fields but conn and writer are guarded
+// by the mutex of the server.
+type client struct {
+	conn   net.Conn
+	writer sync.Mutex
+	worker string
+
+	difficulty int
+	nonceStart int64
+	shares     map[string]map[int64]bool
+	rejected   int
+}
+
+func (c *client) send(message interface{}) error {
+	c.writer.Lock()
+	defer c.writer.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return json.NewEncoder(c.conn).Encode(message)
+}
+
+// Server hands out jobs paying to a single address and accounts the shares
+// of every worker, the way a small pool does.
+type Server struct {
+	payoutAddress   string
+	shareDifficulty int
+
+	listener net.Listener
+	done     chan struct{}
+
+	refreshInterval time.Duration
+
+	mutex      sync.Mutex
+	jobId      int64
+	jobs       []tipJob
+	nonceRange int64
+	clients    map[*client]bool
+	workers    map[string]*WorkerStats
+}
+
+// tipJob is a block template handed out under a job id. The server keeps the
+// jobs built on the current tip, the last one being the current job.
+type tipJob struct {
+	id       string
+	template block.BlockTemplate
+}
+
+// NewServer creates a server whose blocks pay to payoutAddress. Share hashes
+// must start with shareDifficulty zero bits, unless the worker asks for
+// another difficulty, or meet the block target when it is easier.
+func NewServer(payoutAddress string, shareDifficulty int) *Server {
+	return &Server{
+		payoutAddress:   payoutAddress,
+		shareDifficulty: shareDifficulty,
+		refreshInterval: defaultRefreshInterval,
+		done:            make(chan struct{}),
+		clients:         make(map[*client]bool),
+		workers:         make(map[string]*WorkerStats),
+	}
+}
+
+// SetRefreshInterval sets how often the job is rebuilt while the tip stays
+// the same. It must be called before Listen.
+func (s *Server) SetRefreshInterval(interval time.Duration) {
+	s.refreshInterval = interval
+}
+
+// Listen accepts workers on addr and pushes them a new job whenever the tip
+// changes, until the server is closed.
+func (s *Server) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Listen")
+	}
+	s.listener = listener
+
+	if _, err := s.newJob(); err != nil {
+		listener.Close()
+		return err
+	}
+
+	go s.acceptLoop()
+	go s.jobLoop()
+
+	log.Printf("stratum server listening on %s", listener.Addr())
+	return nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Server) Close() error {
+	close(s.done)
+	err := s.listener.Close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	return err
+}
+
+// Workers returns the share accounting of every worker that subscribed.
+func (s *Server) Workers() []WorkerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	workers := make([]WorkerStats, 0, len(s.workers))
+	for _, stats := range s.workers {
+		workers = append(workers, *stats)
+	}
+	return workers
+}
+
+func (s *Server) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Printf("stratum server stopped accepting workers: %s", err.Error())
+			}
+			return
+		}
+
+		c := &client{conn: conn}
+		s.mutex.Lock()
+		s.clients[c] = true
+		s.mutex.Unlock()
+
+		go s.serve(c)
+	}
+}
+
+func (s *Server) jobLoop() {
+	ticker := time.NewTicker(s.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		changed := block.TipChanged()
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		updated, err := s.newJob()
+		if err != nil {
+			log.Printf("could not build a stratum job: %s", err.Error())
+			continue
+		} else if !updated {
+			continue
+		}
+
+		s.mutex.Lock()
+		clients := s.subscribedClients()
+		s.mutex.Unlock()
+
+		for _, c := range clients {
+			s.notify(c)
+		}
+	}
+}
+
+// newJob builds a job on the current tip with the transaction pool. It
+// tells whether the job changed: on the same tip and with the same
+// transactions the current job is kept.
+func (s *Server) newJob() (bool, error) {
+	template, err := block.GetBlockTemplate(s.payoutAddress)
+	if err != nil {
+		return false, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.jobs) > 0 {
+		current := s.jobs[len(s.jobs)-1].template
+		if current.PreviousHash != template.PreviousHash {
+			s.jobs = nil
+		} else if current.MerkleRoot == template.MerkleRoot {
+			return false, nil
+		}
+	}
+
+	s.jobId++
+	s.jobs = append(s.jobs, tipJob{id: strconv.FormatInt(s.jobId, 16), template: template})
+	if len(s.jobs) > maxTipJobs {
+		s.jobs = s.jobs[len(s.jobs)-maxTipJobs:]
+	}
+	return true, nil
+}
+
+// findJob returns the job of the current tip with id. The caller holds the
+// mutex.
+func (s *Server) findJob(id string) (tipJob, bool) {
+	for _, job := range s.jobs {
+		if job.id == id {
+			return job, true
+		}
+	}
+	return tipJob{}, false
+}
+
+// jobFor returns job as handed to c, with its share target and nonce range.
+// CleanJobs is only set on the first job of a tip. The caller holds the
+// mutex.
+func (s *Server) jobFor(c *client, job tipJob) Job {
+	shareBits := block.DifficultyToBits(c.difficulty)
+	if block.CompactToBig(job.template.Bits).Cmp(block.CompactToBig(shareBits)) > 0 {
+		shareBits = job.template.Bits
+	}
+
+	return Job{
+		Id:            job.id,
+		BlockTemplate: job.template,
+		ShareBits:     shareBits,
+		NonceStart:    c.nonceStart,
+		NonceEnd:      c.nonceStart + 1<<nonceRangeBits,
+		CleanJobs:     job.id == s.jobs[0].id,
+	}
+}
+
+func (s *Server) subscribedClients() []*client {
+	var clients []*client
+	for c := range s.clients {
+		if c.worker != "" {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+func (s *Server) notify(c *client) {
+	s.mutex.Lock()
+	job := s.jobFor(c, s.jobs[len(s.jobs)-1])
+	worker := c.worker
+	s.mutex.Unlock()
+
+	if err := c.send(Notification{Method: METHOD_NOTIFY, Params: job}); err != nil {
+		log.Printf("could not send job to worker %s: %s", worker, err.Error())
+		c.conn.Close()
+	}
+}
+
+func (s *Server) serve(c *client) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.clients, c)
+		s.mutex.Unlock()
+		c.conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		var request Request
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			log.Printf("invalid stratum request: %s", err.Error())
+			return
+		}
+
+		result, err := s.handle(c, request)
+		response := Response{Id: request.Id, Result: result}
+		if err != nil {
+			message := err.Error()
+			response.Error = &message
+		}
+
+		if err := c.send(response); err != nil {
+			return
+		}
+
+		if request.Method == METHOD_SUBSCRIBE && err == nil {
+			s.notify(c)
+		}
+
+		if s.tooManyRejected(c) {
+			log.Printf("disconnecting stratum worker at %s after %d rejected shares in a row", c.conn.RemoteAddr(), maxRejectedShares)
+			return
+		}
+	}
+}
+
+func (s *Server) handle(c *client, request Request) (interface{}, error) {
+	switch request.Method {
+	case METHOD_SUBSCRIBE:
+		var params SubscribeParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, errors.Wrap(err, "invalid subscribe params")
+		}
+		return s.subscribe(c, params)
+	case METHOD_SUBMIT:
+		var params SubmitParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, errors.Wrap(err, "invalid submit params")
+		}
+		return s.submit(c, params)
+	default:
+		return nil, errors.Errorf("unknown method %s", request.Method)
+	}
+}
+
+func (s *Server) subscribe(c *client, params SubscribeParams) (SubscribeResult, error) {
+	if params.Worker == "" {
+		return SubscribeResult{}, errors.New("worker name is required")
+	}
+
+	difficulty := params.Difficulty
+	if difficulty == 0 {
+		difficulty = s.shareDifficulty
+	}
+	if difficulty < 1 || difficulty > maxDifficulty {
+		return SubscribeResult{}, errors.Errorf("difficulty %d is not between 1 and %d", difficulty, maxDifficulty)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if c.worker == "" {
+		c.nonceStart = s.nonceRange << nonceRangeBits
+		s.nonceRange = (s.nonceRange + 1) % nonceRanges
+	}
+	c.worker = params.Worker
+	c.difficulty = difficulty
+
+	stats, found := s.workers[params.Worker]
+	if !found {
+		stats = &WorkerStats{Name: params.Worker}
+		s.workers[params.Worker] = stats
+	}
+	stats.Difficulty = difficulty
+
+	log.Printf("stratum worker %s subscribed from %s", params.Worker, c.conn.RemoteAddr())
+	return SubscribeResult{Worker: params.Worker, Difficulty: difficulty}, nil
+}
+
+func (s *Server) submit(c *client, params SubmitParams) (SubmitResult, error) {
+	s.mutex.Lock()
+	if c.worker == "" {
+		s.mutex.Unlock()
+		return SubmitResult{}, errors.New("not subscribed")
+	}
+
+	stats := s.workers[c.worker]
+	worker := c.worker
+	handed, found := s.findJob(params.JobId)
+	if !found {
+		stats.Stale++
+		s.mutex.Unlock()
+		return SubmitResult{}, errors.Errorf("stale job %s", params.JobId)
+	}
+
+	job := s.jobFor(c, handed)
+	if params.Nonce < job.NonceStart || params.Nonce >= job.NonceEnd {
+		s.reject(c, stats)
+		s.mutex.Unlock()
+		return SubmitResult{}, errors.Errorf("nonce %d is outside of the worker's range", params.Nonce)
+	}
+
+	if c.shares[job.Id][params.Nonce] {
+		s.reject(c, stats)
+		s.mutex.Unlock()
+		return SubmitResult{}, errors.New("duplicate share")
+	}
+	s.mutex.Unlock()
+
+	candidate := job.Block(params.Nonce)
+	if !block.HasMatchesTarget(candidate.Hash, job.ShareBits) {
+		s.mutex.Lock()
+		s.reject(c, stats)
+		s.mutex.Unlock()
+		return SubmitResult{}, errors.New("share does not meet the share target")
+	}
+
+	if err := s.recordShare(c, job.Id, params.Nonce); err != nil {
+		return SubmitResult{}, err
+	}
+
+	if !block.HasMatchesTarget(candidate.Hash, job.Bits) {
+		s.account(c, stats, false)
+		return SubmitResult{Accepted: true}, nil
+	}
+
+	if err := block.SubmitBlock(candidate); err != nil {
+		log.Printf("block %s found by worker %s was rejected: %s", candidate.Hash, worker, err.Error())
+		s.account(c, stats, false)
+		return SubmitResult{Accepted: true}, nil
+	}
+
+	log.Printf("worker %s found block %s", worker, candidate.Hash)
+	s.account(c, stats, true)
+	// the tip may have moved on since the job, leaving the block on a side branch
+	if block.GetLatestBlock().Hash == candidate.Hash {
+		p2p.BroadcastLatest()
+	}
+	return SubmitResult{Accepted: true, Block: candidate.Hash}, nil
+}
+
+// recordShare remembers the nonce of a valid share of c for job, so that it
+// is not accepted twice. Only the jobs of the current tip are kept, each up
+// to maxJobShares shares.
+func (s *Server) recordShare(c *client, jobId string, nonce int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id := range c.shares {
+		if _, found := s.findJob(id); !found {
+			delete(c.shares, id)
+		}
+	}
+
+	if c.shares == nil {
+		c.shares = make(map[string]map[int64]bool)
+	}
+	if c.shares[jobId] == nil {
+		c.shares[jobId] = make(map[int64]bool)
+	}
+
+	if len(c.shares[jobId]) >= maxJobShares {
+		return errors.Errorf("job %s already has %d shares, wait for the next job", jobId, maxJobShares)
+	}
+	c.shares[jobId][nonce] = true
+	return nil
+}
+
+// reject accounts a rejected share of c. The caller holds the mutex.
+func (s *Server) reject(c *client, stats *WorkerStats) {
+	stats.Rejected++
+	c.rejected++
+}
+
+// tooManyRejected tells whether c sent maxRejectedShares rejected shares in
+// a row.
+func (s *Server) tooManyRejected(c *client) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return c.rejected >= maxRejectedShares
+}
+
+// account counts an accepted share of c.
+func (s *Server) account(c *client, stats *WorkerStats, foundBlock bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c.rejected = 0
+	stats.Accepted++
+	stats.LastShare = time.Now()
+	if foundBlock {
+		stats.Blocks++
+	}
+}
@@ -0,0 +1,322 @@
+package stratum_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-naivecoin/block"
+	"github.com/go-naivecoin/params"
+	"github.com/go-naivecoin/stratum"
+	"github.com/go-naivecoin/tx"
+	"github.com/go-naivecoin/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	PRIVATE_KEY = "0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+	ADDRESS     = "04115c42e757b2efb7671c578530ec191a1359381e6a71127a9d37c486fd30dae57e76dc58f693bd7e7010358ce6b165e483a2921010db67ac11b1b51b651953d2"
+)
+
+type worker struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	id      int64
+	jobs    []stratum.Job
+}
+
+func (w *worker) call(t *testing.T, method string, params interface{}) {
+	w.id++
+	id := w.id
+	raw, _ := json.Marshal(params)
+	assert.Nil(t, json.NewEncoder(w.conn).Encode(stratum.Request{Id: &id, Method: method, Params: raw}))
+}
+
+type message struct {
+	Method string               `json:"method"`
+	Params stratum.Job          `json:"params"`
+	Result stratum.SubmitResult `json:"result"`
+	Error  *string              `json:"error"`
+}
+
+// read returns the next message, keeping aside the jobs pushed meanwhile
+// when a response is expected.
+func (w *worker) read(t *testing.T, wantJob bool) message {
+	for w.scanner.Scan() {
+		var m message
+		assert.Nil(t, json.Unmarshal(w.scanner.Bytes(), &m))
+
+		if (m.Method == stratum.METHOD_NOTIFY) == wantJob {
+			return m
+		}
+		if m.Method == stratum.METHOD_NOTIFY {
+			w.jobs = append(w.jobs, m.Params)
+		}
+	}
+
+	t.Fatal("connection closed")
+	return message{}
+}
+
+func (w *worker) readJob(t *testing.T) stratum.Job {
+	if len(w.jobs) > 0 {
+		job := w.jobs[0]
+		w.jobs = w.jobs[1:]
+		return job
+	}
+	return w.read(t, true).Params
+}
+
+func TestServer_SubmitShares_ThenNewJobOnBlock(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	server := stratum.NewServer(ADDRESS, 4)
+	assert.Nil(t, server.Listen("127.0.0.1:0"))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	w := &worker{conn: conn, scanner: bufio.NewScanner(conn)}
+
+	w.call(t, stratum.METHOD_SUBSCRIBE, stratum.SubscribeParams{Worker: "rig1"})
+	assert.Nil(t, w.read(t, false).Error)
+
+	job := w.readJob(t)
+	assert.Equal(t, block.GetLatestBlock().Hash, job.PreviousHash)
+	assert.Equal(t, job.Bits, job.ShareBits)
+
+	solved := block.FindBlock(job.Index, job.PreviousHash, job.Timestamp, job.Data(), job.Bits)
+	w.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: job.Id, Nonce: solved.Nonce})
+	response := w.read(t, false)
+	assert.Nil(t, response.Error)
+	assert.True(t, response.Result.Accepted)
+	assert.Equal(t, solved.Hash, response.Result.Block)
+	assert.Equal(t, solved.Hash, block.GetLatestBlock().Hash)
+
+	next := w.readJob(t)
+	assert.Equal(t, solved.Hash, next.PreviousHash)
+	assert.True(t, next.CleanJobs)
+
+	w.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: job.Id, Nonce: solved.Nonce})
+	assert.NotNil(t, w.read(t, false).Error)
+
+	workers := server.Workers()
+	assert.Len(t, workers, 1)
+	assert.Equal(t, "rig1", workers[0].Name)
+	assert.Equal(t, 1, workers[0].Accepted)
+	assert.Equal(t, 1, workers[0].Blocks)
+	assert.Equal(t, 1, workers[0].Stale)
+}
+
+func TestServer_SubmitBeforeSubscribe(t *testing.T) {
+	server := stratum.NewServer(ADDRESS, 4)
+	assert.Nil(t, server.Listen("127.0.0.1:0"))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	w := &worker{conn: conn, scanner: bufio.NewScanner(conn)}
+
+	w.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: "1", Nonce: 0})
+	assert.NotNil(t, w.read(t, false).Error)
+}
+
+func subscribe(t *testing.T, server *stratum.Server, params stratum.SubscribeParams) *worker {
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	w := &worker{conn: conn, scanner: bufio.NewScanner(conn)}
+
+	w.call(t, stratum.METHOD_SUBSCRIBE, params)
+	assert.Nil(t, w.read(t, false).Error)
+	return w
+}
+
+// searchNonce returns the first nonce of the range of job whose block hash
+// meets, or misses, the share target.
+func searchNonce(job stratum.Job, meetsShareTarget bool) int64 {
+	for nonce := job.NonceStart; ; nonce++ {
+		if block.HasMatchesTarget(job.Block(nonce).Hash, job.ShareBits) == meetsShareTarget {
+			return nonce
+		}
+	}
+}
+
+func TestServer_WorkersGetTheirOwnNonceRangeAndDifficulty(t *testing.T) {
+	assert.Nil(t, block.InitBlockStore(""))
+	defer block.InitBlockStore("")
+
+	server := stratum.NewServer(ADDRESS, 4)
+	assert.Nil(t, server.Listen("127.0.0.1:0"))
+	defer server.Close()
+
+	first := subscribe(t, server, stratum.SubscribeParams{Worker: "rig1"})
+	defer first.conn.Close()
+	second := subscribe(t, server, stratum.SubscribeParams{Worker: "rig2", Difficulty: 8})
+	defer second.conn.Close()
+
+	firstJob := first.readJob(t)
+	secondJob := second.readJob(t)
+	assert.Equal(t, firstJob.Id, secondJob.Id)
+	assert.True(t, firstJob.NonceEnd <= secondJob.NonceStart || secondJob.NonceEnd <= firstJob.NonceStart)
+	assert.Equal(t, firstJob.Bits, firstJob.ShareBits)
+
+	// A nonce of the range of another worker is not a share.
+	first.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: firstJob.Id, Nonce: secondJob.NonceStart})
+	assert.NotNil(t, first.read(t, false).Error)
+
+	// Nonces missing the share target are not recorded as shares.
+	missed := searchNonce(secondJob, false)
+	second.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: secondJob.Id, Nonce: missed})
+	assert.Contains(t, *second.read(t, false).Error, "share target")
+	second.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: secondJob.Id, Nonce: missed})
+	assert.Contains(t, *second.read(t, false).Error, "share target")
+
+	missed = searchNonce(firstJob, false)
+	first.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: firstJob.Id, Nonce: missed})
+	assert.Contains(t, *first.read(t, false).Error, "share target")
+
+	solved := searchNonce(secondJob, true)
+	second.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: secondJob.Id, Nonce: solved})
+	response := second.read(t, false)
+	assert.Nil(t, response.Error)
+	assert.Equal(t, secondJob.Block(solved).Hash, response.Result.Block)
+
+	for _, stats := range server.Workers() {
+		switch stats.Name {
+		case "rig1":
+			assert.Equal(t, 4, stats.Difficulty)
+			assert.Equal(t, 0, stats.Accepted)
+			assert.Equal(t, 2, stats.Rejected)
+		case "rig2":
+			assert.Equal(t, 8, stats.Difficulty)
+			assert.Equal(t, 1, stats.Blocks)
+			assert.Equal(t, 2, stats.Rejected)
+		}
+	}
+}
+
+func TestServer_SubscribeWithInvalidDifficulty(t *testing.T) {
+	server := stratum.NewServer(ADDRESS, 4)
+	assert.Nil(t, server.Listen("127.0.0.1:0"))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	w := &worker{conn: conn, scanner: bufio.NewScanner(conn)}
+
+	w.call(t, stratum.METHOD_SUBSCRIBE, stratum.SubscribeParams{Worker: "rig1", Difficulty: 256})
+	assert.NotNil(t, w.read(t, false).Error)
+}
+
+// useBlockDifficulty runs on a fresh regtest chain whose blocks start with
+// leadingZeroBits zero bits, so that easier shares are not blocks, until the
+// returned function restores mainnet.
+func useBlockDifficulty(leadingZeroBits int) func() {
+	chainParams := params.RegTestParams
+	chainParams.GenesisBits = block.DifficultyToBits(leadingZeroBits)
+	chainParams.CoinbaseMaturity = 1
+	params.SetActive(&chainParams)
+	block.InitBlockStore("")
+
+	return func() {
+		params.SetActive(&params.MainNetParams)
+		block.InitBlockStore("")
+	}
+}
+
+// searchBlockNonce returns the first nonce of the range of job whose block
+// hash meets, or misses, the block target while meeting the share target.
+func searchBlockNonce(job stratum.Job, meetsBlockTarget bool) int64 {
+	for nonce := job.NonceStart; ; nonce++ {
+		hash := job.Block(nonce).Hash
+		if block.HasMatchesTarget(hash, job.ShareBits) && block.HasMatchesTarget(hash, job.Bits) == meetsBlockTarget {
+			return nonce
+		}
+	}
+}
+
+func TestServer_DuplicateShares_ThenJunkDisconnects(t *testing.T) {
+	defer useBlockDifficulty(12)()
+
+	server := stratum.NewServer(ADDRESS, 4)
+	assert.Nil(t, server.Listen("127.0.0.1:0"))
+	defer server.Close()
+
+	w := subscribe(t, server, stratum.SubscribeParams{Worker: "rig1"})
+	defer w.conn.Close()
+	job := w.readJob(t)
+
+	share := searchBlockNonce(job, false)
+	w.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: job.Id, Nonce: share})
+	response := w.read(t, false)
+	assert.Nil(t, response.Error)
+	assert.True(t, response.Result.Accepted)
+
+	w.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: job.Id, Nonce: share})
+	assert.Contains(t, *w.read(t, false).Error, "duplicate")
+
+	// junk nonces are not recorded, but the worker is dropped after enough
+	var submitted int
+	for nonce := job.NonceStart; submitted < 1000; nonce++ {
+		if block.HasMatchesTarget(job.Block(nonce).Hash, job.ShareBits) {
+			continue
+		}
+
+		w.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: job.Id, Nonce: nonce})
+		submitted++
+		if !w.scanner.Scan() {
+			break
+		}
+	}
+	assert.True(t, submitted < 1000)
+}
+
+func TestServer_RefreshesJobWithPoolTransactions(t *testing.T) {
+	defer useBlockDifficulty(8)()
+
+	myAddress, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		template, err := block.GetBlockTemplate(myAddress)
+		assert.Nil(t, err)
+		assert.Nil(t, block.SubmitBlock(block.FindBlock(template.Index, template.PreviousHash, template.Timestamp, template.Data(), template.Bits)))
+	}
+
+	server := stratum.NewServer(ADDRESS, 4)
+	server.SetRefreshInterval(20 * time.Millisecond)
+	assert.Nil(t, server.Listen("127.0.0.1:0"))
+	defer server.Close()
+
+	w := subscribe(t, server, stratum.SubscribeParams{Worker: "rig1"})
+	defer w.conn.Close()
+	first := w.readJob(t)
+	assert.Len(t, first.Transactions, 0)
+
+	spendHeight := block.GetLatestBlock().Index + 1
+	transaction, err := wallet.CreateTransaction(ADDRESS, 10, 1, PRIVATE_KEY, block.GetUnpentTxOuts(), tx.GetTransactionPool(), spendHeight)
+	assert.Nil(t, err)
+	assert.Nil(t, block.HandleReceivedTransaction(transaction))
+
+	refreshed := w.readJob(t)
+	assert.Equal(t, first.PreviousHash, refreshed.PreviousHash)
+	assert.False(t, refreshed.CleanJobs)
+	assert.Len(t, refreshed.Transactions, 1)
+	assert.Equal(t, int64(1), refreshed.Fees)
+
+	// shares of the first job of the tip still count
+	w.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: first.Id, Nonce: searchBlockNonce(first, false)})
+	assert.Nil(t, w.read(t, false).Error)
+
+	solved := searchBlockNonce(refreshed, true)
+	w.call(t, stratum.METHOD_SUBMIT, stratum.SubmitParams{JobId: refreshed.Id, Nonce: solved})
+	response := w.read(t, false)
+	assert.Nil(t, response.Error)
+	assert.Equal(t, refreshed.Block(solved).Hash, response.Result.Block)
+	assert.Len(t, tx.GetTransactionPool(), 0)
+}
@@ -0,0 +1,123 @@
+package tx
+
+import (
+	"github.com/go-naivecoin/wire"
+	"github.com/pkg/errors"
+)
+
+// TX_ENCODING_VERSION is the first field of every encoded transaction.
+const TX_ENCODING_VERSION = 2
+
+// smallest encodings, to bound the lists a decoder allocates
+const (
+	minTxInSize  = 1 + 8 + 8 + 1
+	minTxOutSize = 1 + 8
+)
+
+func (txIn TxIn) encode(w *wire.Writer, withSignature bool) {
+	w.WriteString(txIn.TxOutId)
+	w.WriteInt64(txIn.TxOutIndex)
+	w.WriteInt64(txIn.RelativeLock)
+	if withSignature {
+		w.WriteString(txIn.Signature)
+	} else {
+		w.WriteString("")
+	}
+}
+
+func (txIn *TxIn) decode(r *wire.Reader) {
+	txIn.TxOutId = r.ReadString()
+	txIn.TxOutIndex = r.ReadInt64()
+	txIn.RelativeLock = r.ReadInt64()
+	txIn.Signature = r.ReadString()
+}
+
+func (txIn TxIn) MarshalBinary() ([]byte, error) {
+	var w wire.Writer
+	txIn.encode(&w, true)
+	return w.Bytes(), nil
+}
+
+func (txIn *TxIn) UnmarshalBinary(data []byte) error {
+	r := wire.NewReader(data)
+	txIn.decode(r)
+	return errors.Wrap(r.Close(), "TxIn-UnmarshalBinary")
+}
+
+func (txOut TxOut) encode(w *wire.Writer) {
+	w.WriteString(txOut.Address)
+	w.WriteInt64(txOut.Amount)
+}
+
+func (txOut *TxOut) decode(r *wire.Reader) {
+	txOut.Address = r.ReadString()
+	txOut.Amount = r.ReadInt64()
+}
+
+func (txOut TxOut) MarshalBinary() ([]byte, error) {
+	var w wire.Writer
+	txOut.encode(&w)
+	return w.Bytes(), nil
+}
+
+func (txOut *TxOut) UnmarshalBinary(data []byte) error {
+	r := wire.NewReader(data)
+	txOut.decode(r)
+	return errors.Wrap(r.Close(), "TxOut-UnmarshalBinary")
+}
+
+// encode writes the version, the inputs and the outputs each prefixed with
+// their count, then the lock time. The id is the hash of the encoding without signatures.
+func (t Transaction) encode(w *wire.Writer, withSignatures bool) {
+	w.WriteUint32(TX_ENCODING_VERSION)
+
+	w.WriteUvarint(uint64(len(t.TxIns)))
+	for _, txIn := range t.TxIns {
+		txIn.encode(w, withSignatures)
+	}
+
+	w.WriteUvarint(uint64(len(t.TxOuts)))
+	for _, txOut := range t.TxOuts {
+		txOut.encode(w)
+	}
+
+	w.WriteInt64(t.LockTime)
+}
+
+func (t *Transaction) decode(r *wire.Reader) error {
+	if version := r.ReadUint32(); r.Err() == nil && version != TX_ENCODING_VERSION {
+		return errors.Errorf("unknown transaction encoding version %d", version)
+	}
+
+	t.TxIns = make([]TxIn, r.ReadCount(minTxInSize))
+	for i := range t.TxIns {
+		t.TxIns[i].decode(r)
+	}
+
+	t.TxOuts = make([]TxOut, r.ReadCount(minTxOutSize))
+	for i := range t.TxOuts {
+		t.TxOuts[i].decode(r)
+	}
+
+	t.LockTime = r.ReadInt64()
+
+	t.Id = t.GetTransactionId()
+	return r.Err()
+}
+
+// MarshalBinary returns the canonical encoding of the transaction, with its
+// signatures.
+func (t Transaction) MarshalBinary() ([]byte, error) {
+	var w wire.Writer
+	t.encode(&w, true)
+	return w.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a transaction and computes its id.
+func (t *Transaction) UnmarshalBinary(data []byte) error {
+	r := wire.NewReader(data)
+	if err := t.decode(r); err != nil {
+		return errors.Wrap(err, "Transaction-UnmarshalBinary")
+	}
+	return errors.Wrap(r.Close(), "Transaction-UnmarshalBinary")
+}
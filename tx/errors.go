@@ -0,0 +1,22 @@
+package tx
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Reasons a transaction is rejected. They are returned wrapped with the
+// details of the rejected transaction, errors.Cause tells them apart.
+var (
+	ErrKnownTransaction      = errors.New("transaction is already in the pool")
+	ErrBadTxId               = errors.New("transaction id does not match its content")
+	ErrMissingTxOut          = errors.New("referenced txOut is not unspent")
+	ErrImmatureCoinbase      = errors.New("coinbase txOut is not mature")
+	ErrBadSignature          = errors.New("invalid txIn signature")
+	ErrBadScript             = errors.New("txIn script failed")
+	ErrNegativeAmount        = errors.New("negative txOut amount")
+	ErrAmountOutOfRange      = errors.New("amount exceeds the money range")
+	ErrInputsOutputsMismatch = errors.New("txOut amounts exceed txIn amounts")
+	ErrDoubleSpend           = errors.New("txOut is spent twice")
+	ErrBadCoinbase           = errors.New("invalid coinbase transaction")
+	ErrLocked                = errors.New("transaction or txIn is still locked")
+)
@@ -0,0 +1,99 @@
+package tx_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsFinal(t *testing.T) {
+	transaction := tx.Transaction{}
+	assert.True(t, transaction.IsFinal(0, 0))
+
+	transaction.LockTime = 10
+	assert.False(t, transaction.IsFinal(9, 2000000000))
+	assert.True(t, transaction.IsFinal(10, 0))
+
+	transaction.LockTime = 1600000000
+	assert.False(t, transaction.IsFinal(1700000000, 1599999999))
+	assert.True(t, transaction.IsFinal(1, 1600000000))
+}
+
+func TestProcessTransactions_LockTime(t *testing.T) {
+	address, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	utxos := tx.UnspentTxOuts{{TxOutId: "1", TxOutIndex: 0, Address: address, Amount: 50}}
+
+	locked := tx.Transaction{
+		TxIns:    []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}},
+		TxOuts:   []tx.TxOut{{Address: ADDRESS, Amount: 50}},
+		LockTime: 5,
+	}
+	locked.Id = locked.GetTransactionId()
+	signature, err := locked.SignTxIn(0, PRIVATE_KEY, utxos)
+	assert.Nil(t, err)
+	locked.TxIns[0].Signature = signature
+
+	_, err = tx.ProcessTransactions([]tx.Transaction{tx.GetCoinbaseTransaction(ADDRESS, 4), locked}, utxos, 4, 0)
+	assert.Equal(t, tx.ErrLocked, errors.Cause(err))
+
+	_, err = tx.AddToTransactionPool(&locked, utxos, 4, 0)
+	assert.Equal(t, tx.ErrLocked, errors.Cause(err))
+
+	_, err = tx.ProcessTransactions([]tx.Transaction{tx.GetCoinbaseTransaction(ADDRESS, 5), locked}, utxos, 5, 0)
+	assert.Nil(t, err)
+
+	// The lock time is signed.
+	locked.LockTime = 4
+	locked.Id = locked.GetTransactionId()
+	assert.Equal(t, tx.ErrBadSignature, errors.Cause(locked.ValidateTransaction(utxos, 5)))
+}
+
+func TestValidateTransaction_RelativeLock(t *testing.T) {
+	address, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	utxos := tx.UnspentTxOuts{{TxOutId: "1", TxOutIndex: 0, Address: address, Amount: 50, BlockHeight: 10}}
+
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0, RelativeLock: 3}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 50}},
+	}
+	transaction.Id = transaction.GetTransactionId()
+	signature, err := transaction.SignTxIn(0, PRIVATE_KEY, utxos)
+	assert.Nil(t, err)
+	transaction.TxIns[0].Signature = signature
+
+	assert.Equal(t, tx.ErrLocked, errors.Cause(transaction.ValidateTransaction(utxos, 12)))
+	assert.Nil(t, transaction.ValidateTransaction(utxos, 13))
+}
+
+func TestScript_Timelocks(t *testing.T) {
+	// <5> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_1
+	lockTimeScript := hex.EncodeToString([]byte{1, 5, tx.OP_CHECKLOCKTIMEVERIFY, tx.OP_DROP, tx.OP_1})
+	// <3> OP_CHECKSEQUENCEVERIFY OP_DROP OP_1
+	relativeLockScript := hex.EncodeToString([]byte{1, 3, tx.OP_CHECKSEQUENCEVERIFY, tx.OP_DROP, tx.OP_1})
+
+	for _, test := range []struct {
+		address      string
+		lockTime     int64
+		relativeLock int64
+		expected     error
+	}{
+		{lockTimeScript, 4, 0, tx.ErrLocked},
+		{lockTimeScript, 5, 0, nil},
+		{lockTimeScript, 1600000000, 0, tx.ErrLocked},
+		{relativeLockScript, 0, 2, tx.ErrLocked},
+		{relativeLockScript, 0, 3, nil},
+	} {
+		utxos := scriptUtxos(test.address)
+		transaction := spendingTransaction("")
+		transaction.LockTime = test.lockTime
+		transaction.TxIns[0].RelativeLock = test.relativeLock
+		transaction.Id = transaction.GetTransactionId()
+
+		assert.Equal(t, test.expected, errors.Cause(transaction.ValidateTransaction(utxos, 10)))
+	}
+}
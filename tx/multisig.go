@@ -0,0 +1,196 @@
+package tx
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	"github.com/pkg/errors"
+)
+
+// MultisigAddress returns the locking script, in hex, that required of the
+// publicKeys must sign:
+// OP_<required> <key 1> ... <key n> OP_<n> OP_CHECKMULTISIG.
+// It is unlocked with the signatures, in the order of their keys.
+func MultisigAddress(required int, publicKeys []string) (string, error) {
+	if len(publicKeys) == 0 || len(publicKeys) > MAX_MULTISIG_KEYS {
+		return "", errors.Errorf("multisig takes 1 to %d public keys, not %d", MAX_MULTISIG_KEYS, len(publicKeys))
+	} else if required < 1 || required > len(publicKeys) {
+		return "", errors.Errorf("multisig requires 1 to %d signatures, not %d", len(publicKeys), required)
+	}
+
+	script := []byte{OP_1 + byte(required) - 1}
+	for _, publicKey := range publicKeys {
+		pubKeyBytes, err := hex.DecodeString(publicKey)
+		if err != nil {
+			return "", errors.Wrapf(err, "public key %s", publicKey)
+		}
+
+		if _, err := secp256k1.ParsePubKey(pubKeyBytes); err != nil {
+			return "", errors.Wrapf(err, "public key %s", publicKey)
+		}
+		script = pushData(script, pubKeyBytes)
+	}
+	script = append(script, OP_1+byte(len(publicKeys))-1, OP_CHECKMULTISIG)
+
+	if len(script) > MAX_SCRIPT_SIZE {
+		return "", errors.Errorf("multisig script of %d bytes exceeds %d", len(script), MAX_SCRIPT_SIZE)
+	}
+	return hex.EncodeToString(script), nil
+}
+
+// parseMultisigAddress returns the number of required signatures and the
+// keys of a multisig address.
+func parseMultisigAddress(address string) (int, [][]byte, bool) {
+	if isPublicKey(address) {
+		return 0, nil, false
+	}
+
+	script, err := hex.DecodeString(address)
+	if err != nil {
+		return 0, nil, false
+	}
+
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	required, keys := ops[0].opcode, ops[len(ops)-2].opcode
+	if required < OP_1 || required > OP_16 || keys < OP_1 || keys > OP_16 {
+		return 0, nil, false
+	}
+
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if op.opcode == OP_0 || op.opcode > OP_PUSHDATA1 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+
+	if len(pubKeys) != int(keys-OP_1)+1 || int(required-OP_1)+1 > len(pubKeys) {
+		return 0, nil, false
+	}
+	return int(required-OP_1) + 1, pubKeys, true
+}
+
+// ParseMultisigAddress returns the number of required signatures and the
+// public keys of a MultisigAddress, and false for any other address.
+func ParseMultisigAddress(address string) (int, []string, bool) {
+	required, pubKeys, ok := parseMultisigAddress(address)
+
+	var publicKeys []string
+	for _, pubKey := range pubKeys {
+		publicKeys = append(publicKeys, hex.EncodeToString(pubKey))
+	}
+	return required, publicKeys, ok
+}
+
+// partialSignatures returns the keys of the multisig output input txInIndex
+// spends, and the signatures collected so far, one per key and empty where
+// it is missing. Until it is finalised, the Signature of the input pushes
+// them all.
+func (t *Transaction) partialSignatures(txInIndex int64, aUnspentTxOuts UnspentTxOuts) (int, [][]byte, [][]byte, error) {
+	txIn := t.TxIns[txInIndex]
+
+	utxo, found := aUnspentTxOuts.findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex)
+	if !found {
+		return 0, nil, nil, errors.Wrapf(ErrMissingTxOut, "txIn %s:%d", txIn.TxOutId, txIn.TxOutIndex)
+	}
+
+	required, pubKeys, ok := parseMultisigAddress(utxo.Address)
+	if !ok {
+		return 0, nil, nil, errors.Errorf("txIn %s:%d does not spend a multisig output", txIn.TxOutId, txIn.TxOutIndex)
+	}
+
+	signatures := make([][]byte, len(pubKeys))
+	if txIn.Signature == "" {
+		return required, pubKeys, signatures, nil
+	}
+
+	script, err := hex.DecodeString(txIn.Signature)
+	if err != nil {
+		return 0, nil, nil, errors.Wrapf(err, "txIn %s:%d", txIn.TxOutId, txIn.TxOutIndex)
+	}
+
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != len(pubKeys) {
+		return 0, nil, nil, errors.Errorf("txIn %s:%d does not hold one partial signature per key, it may already be finalised", txIn.TxOutId, txIn.TxOutIndex)
+	}
+
+	for i, op := range ops {
+		signatures[i] = op.data
+	}
+	return required, pubKeys, signatures, nil
+}
+
+// SignMultisigTxIn adds the signature of privateKey to the partial
+// signatures of input txInIndex, which spends a multisig output.
+func (t *Transaction) SignMultisigTxIn(txInIndex int64, privateKey string, aUnspentTxOuts UnspentTxOuts, hashType SigHashType) error {
+	_, pubKeys, signatures, err := t.partialSignatures(txInIndex, aUnspentTxOuts)
+	if err != nil {
+		return err
+	}
+
+	skBytes, err := hex.DecodeString(privateKey)
+	if err != nil {
+		return errors.Wrap(err, "SignMultisigTxIn- hex.DecodeString")
+	}
+	privKey, pubKey := secp256k1.PrivKeyFromBytes(skBytes)
+
+	position := -1
+	for i, key := range pubKeys {
+		if bytes.Equal(key, pubKey.SerializeUncompressed()) {
+			position = i
+		}
+	}
+
+	if position < 0 {
+		return errors.New("trying to sign a multisig input with a private key that is not one of its keys")
+	}
+
+	sigHash, err := t.SignatureHash(int(txInIndex), aUnspentTxOuts, hashType)
+	if err != nil {
+		return errors.Wrap(err, "SignMultisigTxIn- SignatureHash")
+	}
+
+	signature, err := privKey.Sign(sigHash)
+	if err != nil {
+		return errors.Wrap(err, "SignMultisigTxIn- privKey.Sign")
+	}
+	signatures[position] = append(signature.Serialize(), byte(hashType))
+
+	var script []byte
+	for _, signature := range signatures {
+		script = pushData(script, signature)
+	}
+	t.TxIns[txInIndex].Signature = hex.EncodeToString(script)
+	return nil
+}
+
+// FinalizeMultisigTxIn turns the partial signatures of input txInIndex into
+// its unlocking script, once enough keys have signed.
+func (t *Transaction) FinalizeMultisigTxIn(txInIndex int64, aUnspentTxOuts UnspentTxOuts) error {
+	required, _, signatures, err := t.partialSignatures(txInIndex, aUnspentTxOuts)
+	if err != nil {
+		return err
+	}
+
+	var script []byte
+	signed := 0
+	for _, signature := range signatures {
+		if len(signature) > 0 && signed < required {
+			script = pushData(script, signature)
+			signed++
+		}
+	}
+
+	if signed < required {
+		txIn := t.TxIns[txInIndex]
+		return errors.Errorf("txIn %s:%d has %d of the %d signatures it requires", txIn.TxOutId, txIn.TxOutIndex, signed, required)
+	}
+
+	t.TxIns[txInIndex].Signature = hex.EncodeToString(script)
+	return nil
+}
@@ -0,0 +1,83 @@
+package tx_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const THIRD_PRIVATE_KEY = "2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90a1b"
+
+func multisigSpend(t *testing.T) (*tx.Transaction, tx.UnspentTxOuts) {
+	var publicKeys []string
+	for _, privateKey := range []string{PRIVATE_KEY, OTHER_PRIVATE_KEY, THIRD_PRIVATE_KEY} {
+		publicKey, err := tx.GetPublicKey(privateKey)
+		assert.Nil(t, err)
+		publicKeys = append(publicKeys, publicKey)
+	}
+
+	address, err := tx.MultisigAddress(2, publicKeys)
+	assert.Nil(t, err)
+
+	required, parsedKeys, ok := tx.ParseMultisigAddress(address)
+	assert.True(t, ok)
+	assert.Equal(t, 2, required)
+	assert.Equal(t, publicKeys, parsedKeys)
+
+	return spendingTransaction(""), scriptUtxos(address)
+}
+
+func TestMultisig_TwoOfThree(t *testing.T) {
+	transaction, utxos := multisigSpend(t)
+
+	assert.Nil(t, transaction.SignMultisigTxIn(0, THIRD_PRIVATE_KEY, utxos, tx.SIGHASH_ALL))
+	assert.NotNil(t, transaction.FinalizeMultisigTxIn(0, utxos))
+
+	assert.Nil(t, transaction.SignMultisigTxIn(0, PRIVATE_KEY, utxos, tx.SIGHASH_ALL))
+	assert.Nil(t, transaction.FinalizeMultisigTxIn(0, utxos))
+	transaction.Id = transaction.GetTransactionId()
+	assert.Nil(t, transaction.ValidateTransaction(utxos, 1))
+
+	// A finalised input takes no more signatures.
+	assert.NotNil(t, transaction.SignMultisigTxIn(0, OTHER_PRIVATE_KEY, utxos, tx.SIGHASH_ALL))
+}
+
+func TestMultisig_Failures(t *testing.T) {
+	transaction, utxos := multisigSpend(t)
+	assert.NotNil(t, transaction.SignMultisigTxIn(0, "0b1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9", utxos, tx.SIGHASH_ALL))
+
+	// A single signature short of the two required.
+	assert.Nil(t, transaction.SignMultisigTxIn(0, PRIVATE_KEY, utxos, tx.SIGHASH_ALL))
+	assert.Equal(t, tx.ErrBadScript, errors.Cause(transaction.ValidateTransaction(utxos, 1)))
+
+	// Signatures out of the order of their keys.
+	first, _ := multisigSpend(t)
+	assert.Nil(t, first.SignMultisigTxIn(0, PRIVATE_KEY, utxos, tx.SIGHASH_ALL))
+	second, _ := multisigSpend(t)
+	assert.Nil(t, second.SignMultisigTxIn(0, OTHER_PRIVATE_KEY, utxos, tx.SIGHASH_ALL))
+	// Partial signatures push OP_0 for each missing one.
+	pushFirst := strings.TrimSuffix(first.TxIns[0].Signature, "0000")
+	pushSecond := strings.TrimSuffix(strings.TrimPrefix(second.TxIns[0].Signature, "00"), "00")
+	swapped := spendingTransaction(pushSecond + pushFirst)
+	assert.Equal(t, tx.ErrBadSignature, errors.Cause(swapped.ValidateTransaction(utxos, 1)))
+}
+
+func TestMultisigAddress_Bounds(t *testing.T) {
+	publicKey, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+
+	_, err = tx.MultisigAddress(0, []string{publicKey})
+	assert.NotNil(t, err)
+	_, err = tx.MultisigAddress(2, []string{publicKey})
+	assert.NotNil(t, err)
+	_, err = tx.MultisigAddress(1, nil)
+	assert.NotNil(t, err)
+	_, err = tx.MultisigAddress(1, []string{"04ab"})
+	assert.NotNil(t, err)
+
+	_, _, ok := tx.ParseMultisigAddress(publicKey)
+	assert.False(t, ok)
+}
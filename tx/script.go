@@ -0,0 +1,573 @@
+package tx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	"github.com/pkg/errors"
+)
+
+// Opcodes of the locking and unlocking scripts. Those below OP_PUSHDATA1
+// push the next that many bytes.
+const (
+	OP_0                   byte = 0x00
+	OP_PUSHDATA1           byte = 0x4c
+	OP_1                   byte = 0x51
+	OP_16                  byte = 0x60
+	OP_VERIFY              byte = 0x69
+	OP_RETURN              byte = 0x6a
+	OP_DROP                byte = 0x75
+	OP_DUP                 byte = 0x76
+	OP_EQUAL               byte = 0x87
+	OP_EQUALVERIFY         byte = 0x88
+	OP_SHA256              byte = 0xa8
+	OP_HASH256             byte = 0xaa
+	OP_CHECKSIG            byte = 0xac
+	OP_CHECKSIGVERIFY      byte = 0xad
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKMULTISIGVERIFY byte = 0xaf
+	// OP_CHECKLOCKTIMEVERIFY and OP_CHECKSEQUENCEVERIFY leave the lock
+	// they check on the stack, follow them with OP_DROP.
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
+	OP_CHECKSEQUENCEVERIFY byte = 0xb2
+)
+
+// bounds of the script interpreter
+const (
+	MAX_SCRIPT_SIZE         = 1000
+	MAX_SCRIPT_ELEMENT_SIZE = 520
+	MAX_STACK_SIZE          = 100
+	MAX_SCRIPT_OPS          = 201
+	MAX_MULTISIG_KEYS       = 16
+	MAX_SCRIPT_NUMBER_SIZE  = 5
+)
+
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+// parseScript splits a script into its opcodes, each push along with the
+// data it pushes.
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > MAX_SCRIPT_SIZE {
+		return nil, errors.Errorf("script of %d bytes exceeds %d", len(script), MAX_SCRIPT_SIZE)
+	}
+
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+
+		size := 0
+		if opcode > OP_0 && opcode < OP_PUSHDATA1 {
+			size = int(opcode)
+		} else if opcode == OP_PUSHDATA1 {
+			if i >= len(script) {
+				return nil, errors.New("script ends in OP_PUSHDATA1")
+			}
+			size = int(script[i])
+			i++
+		}
+
+		if i+size > len(script) {
+			return nil, errors.Errorf("push of %d bytes past the end of the script", size)
+		}
+
+		ops = append(ops, scriptOp{opcode: opcode, data: script[i : i+size]})
+		i += size
+	}
+
+	return ops, nil
+}
+
+func isPushOp(opcode byte) bool {
+	return opcode <= OP_PUSHDATA1 || (opcode >= OP_1 && opcode <= OP_16)
+}
+
+// pushData appends the smallest push of data to script.
+func pushData(script []byte, data []byte) []byte {
+	if len(data) < int(OP_PUSHDATA1) {
+		script = append(script, byte(len(data)))
+	} else {
+		script = append(script, OP_PUSHDATA1, byte(len(data)))
+	}
+	return append(script, data...)
+}
+
+func hash256(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// isPublicKey tells pay-to-pubkey addresses, a bare uncompressed public key,
+// from the hex locking scripts of other outputs.
+func isPublicKey(address string) bool {
+	if len(address) != 130 || address[:2] != "04" {
+		return false
+	}
+	_, err := hex.DecodeString(address)
+	return err == nil
+}
+
+// PayToPubKeyHashAddress returns the standard locking script, in hex, paying
+// to the HASH256 of publicKey:
+// OP_DUP OP_HASH256 <hash> OP_EQUALVERIFY OP_CHECKSIG.
+// It is unlocked with <signature> <public key>.
+func PayToPubKeyHashAddress(publicKey string) (string, error) {
+	pubKeyBytes, err := hex.DecodeString(publicKey)
+	if err != nil {
+		return "", errors.Wrap(err, "PayToPubKeyHashAddress- hex.DecodeString")
+	}
+
+	if _, err := secp256k1.ParsePubKey(pubKeyBytes); err != nil {
+		return "", errors.Wrap(err, "PayToPubKeyHashAddress- ParsePubKey")
+	}
+
+	script := []byte{OP_DUP, OP_HASH256}
+	script = pushData(script, hash256(pubKeyBytes))
+	script = append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+	return hex.EncodeToString(script), nil
+}
+
+// ParseLockingScript returns the locking script of address when it is one
+// the node pays to: a bare public key, a pay-to-pubkey-hash script or a
+// multisig script whose keys are all valid. Any other address would lock
+// its outputs for good.
+func ParseLockingScript(address string) ([]byte, error) {
+	if isPublicKey(address) {
+		pubKeyBytes, _ := hex.DecodeString(address)
+		if _, err := secp256k1.ParsePubKey(pubKeyBytes); err != nil {
+			return nil, errors.Wrap(err, "invalid public key")
+		}
+		return lockingScript(address)
+	}
+
+	script, err := hex.DecodeString(address)
+	if err != nil {
+		return nil, errors.Errorf("address is neither a public key nor a hex script")
+	}
+
+	if isPayToPubKeyHash(script) {
+		return script, nil
+	}
+
+	if _, pubKeys, ok := parseMultisigAddress(address); ok {
+		for _, pubKey := range pubKeys {
+			if _, err := secp256k1.ParsePubKey(pubKey); err != nil {
+				return nil, errors.Wrap(err, "invalid multisig public key")
+			}
+		}
+		return script, nil
+	}
+
+	return nil, errors.New("address is neither a public key, a pay-to-pubkey-hash nor a multisig script")
+}
+
+// isPayToPubKeyHash tells whether script is the one PayToPubKeyHashAddress
+// builds.
+func isPayToPubKeyHash(script []byte) bool {
+	return len(script) == 37 &&
+		script[0] == OP_DUP && script[1] == OP_HASH256 && script[2] == 32 &&
+		script[35] == OP_EQUALVERIFY && script[36] == OP_CHECKSIG
+}
+
+// lockingScript returns the script of the output paying to address. A bare
+// public key pays to <public key> OP_CHECKSIG.
+func lockingScript(address string) ([]byte, error) {
+	if isPublicKey(address) {
+		pubKeyBytes, _ := hex.DecodeString(address)
+		return append(pushData(nil, pubKeyBytes), OP_CHECKSIG), nil
+	}
+
+	return hex.DecodeString(address)
+}
+
+// unlockingScript returns the script of txIn, spending the output paying to
+// address. Inputs spending a bare public key hold just the signature.
+func unlockingScript(txIn TxIn, address string) ([]byte, error) {
+	script, err := hex.DecodeString(txIn.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if isPublicKey(address) {
+		return pushData(nil, script), nil
+	}
+	return script, nil
+}
+
+// verifyTxInScript runs the unlocking script of input txInIndex, then the
+// locking script of utxo on the stack it leaves. The input may spend the
+// output if neither fails and the top of the stack is true.
+func (t *Transaction) verifyTxInScript(txInIndex int, utxo UnspentTxOut, aUnspentTxOuts UnspentTxOuts) error {
+	locking, err := lockingScript(utxo.Address)
+	if err != nil {
+		return errors.Wrapf(ErrBadScript, "locking script: %s", err.Error())
+	}
+
+	unlocking, err := unlockingScript(t.TxIns[txInIndex], utxo.Address)
+	if err != nil {
+		return errors.Wrapf(ErrBadScript, "unlocking script: %s", err.Error())
+	}
+
+	unlockingOps, err := parseScript(unlocking)
+	if err != nil {
+		return errors.Wrapf(ErrBadScript, "unlocking script: %s", err.Error())
+	}
+
+	for _, op := range unlockingOps {
+		if !isPushOp(op.opcode) {
+			return errors.Wrapf(ErrBadScript, "unlocking script has opcode %#x, it may only push data", op.opcode)
+		}
+	}
+
+	lockingOps, err := parseScript(locking)
+	if err != nil {
+		return errors.Wrapf(ErrBadScript, "locking script: %s", err.Error())
+	}
+
+	engine := scriptEngine{transaction: t, txInIndex: txInIndex, unspentTxOuts: aUnspentTxOuts}
+	if err := engine.execute(unlockingOps); err != nil {
+		return err
+	}
+	if err := engine.execute(lockingOps); err != nil {
+		return err
+	}
+
+	if len(engine.stack) == 0 || !asBool(engine.stack[len(engine.stack)-1]) {
+		return errors.Wrap(ErrBadScript, "script ends false")
+	}
+	return nil
+}
+
+// scriptEngine runs the scripts of one input of a transaction.
+type scriptEngine struct {
+	transaction   *Transaction
+	txInIndex     int
+	unspentTxOuts UnspentTxOuts
+	stack         [][]byte
+	opCount       int
+}
+
+func asBool(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func fromBool(value bool) []byte {
+	if value {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+func (e *scriptEngine) push(data []byte) error {
+	if len(data) > MAX_SCRIPT_ELEMENT_SIZE {
+		return errors.Wrapf(ErrBadScript, "push of %d bytes exceeds %d", len(data), MAX_SCRIPT_ELEMENT_SIZE)
+	} else if len(e.stack) >= MAX_STACK_SIZE {
+		return errors.Wrapf(ErrBadScript, "stack exceeds %d items", MAX_STACK_SIZE)
+	}
+
+	e.stack = append(e.stack, data)
+	return nil
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, errors.Wrap(ErrBadScript, "pop from an empty stack")
+	}
+
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return top, nil
+}
+
+func (e *scriptEngine) execute(ops []scriptOp) error {
+	for _, op := range ops {
+		if !isPushOp(op.opcode) {
+			e.opCount++
+			if e.opCount > MAX_SCRIPT_OPS {
+				return errors.Wrapf(ErrBadScript, "script runs more than %d opcodes", MAX_SCRIPT_OPS)
+			}
+		}
+
+		if err := e.step(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *scriptEngine) step(op scriptOp) error {
+	switch {
+	case op.opcode <= OP_PUSHDATA1:
+		return e.push(op.data)
+	case op.opcode >= OP_1 && op.opcode <= OP_16:
+		return e.push([]byte{op.opcode - OP_1 + 1})
+	}
+
+	switch op.opcode {
+	case OP_VERIFY:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if !asBool(top) {
+			return errors.Wrap(ErrBadScript, "OP_VERIFY failed")
+		}
+
+	case OP_RETURN:
+		return errors.Wrap(ErrBadScript, "OP_RETURN")
+
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+
+	case OP_DUP:
+		if len(e.stack) == 0 {
+			return errors.Wrap(ErrBadScript, "OP_DUP on an empty stack")
+		}
+		return e.push(e.stack[len(e.stack)-1])
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+
+		if op.opcode == OP_EQUALVERIFY {
+			if !bytes.Equal(a, b) {
+				return errors.Wrap(ErrBadScript, "OP_EQUALVERIFY failed")
+			}
+			return nil
+		}
+		return e.push(fromBool(bytes.Equal(a, b)))
+
+	case OP_SHA256, OP_HASH256:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+
+		if op.opcode == OP_SHA256 {
+			hash := sha256.Sum256(top)
+			return e.push(hash[:])
+		}
+		return e.push(hash256(top))
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+
+		valid, err := e.checkSig(signature, pubKey)
+		if err != nil {
+			return err
+		}
+
+		if op.opcode == OP_CHECKSIGVERIFY {
+			if !valid {
+				return errors.Wrap(ErrBadSignature, "OP_CHECKSIGVERIFY failed")
+			}
+			return nil
+		}
+		return e.push(fromBool(valid))
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		valid, err := e.checkMultisig()
+		if err != nil {
+			return err
+		}
+
+		if op.opcode == OP_CHECKMULTISIGVERIFY {
+			if !valid {
+				return errors.Wrap(ErrBadSignature, "OP_CHECKMULTISIGVERIFY failed")
+			}
+			return nil
+		}
+		return e.push(fromBool(valid))
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		lockTime, err := e.peekNumber()
+		if err != nil {
+			return err
+		}
+
+		// heights and times do not compare
+		txLockTime := e.transaction.LockTime
+		if (lockTime < LOCKTIME_THRESHOLD) != (txLockTime < LOCKTIME_THRESHOLD) || txLockTime < lockTime {
+			return errors.Wrapf(ErrLocked, "OP_CHECKLOCKTIMEVERIFY requires lock time %d, tx has %d", lockTime, txLockTime)
+		}
+
+	case OP_CHECKSEQUENCEVERIFY:
+		relativeLock, err := e.peekNumber()
+		if err != nil {
+			return err
+		}
+
+		if txRelativeLock := e.transaction.TxIns[e.txInIndex].RelativeLock; txRelativeLock < relativeLock {
+			return errors.Wrapf(ErrLocked, "OP_CHECKSEQUENCEVERIFY requires relative lock %d, txIn has %d", relativeLock, txRelativeLock)
+		}
+
+	default:
+		return errors.Wrapf(ErrBadScript, "unknown opcode %#x", op.opcode)
+	}
+
+	return nil
+}
+
+// peekNumber reads the top of the stack as a little endian number of up to
+// MAX_SCRIPT_NUMBER_SIZE bytes, with the sign in the top bit of the last
+// byte, and fails on negative numbers.
+func (e *scriptEngine) peekNumber() (int64, error) {
+	if len(e.stack) == 0 {
+		return 0, errors.Wrap(ErrBadScript, "read of a number from an empty stack")
+	}
+
+	data := e.stack[len(e.stack)-1]
+	if len(data) > MAX_SCRIPT_NUMBER_SIZE {
+		return 0, errors.Wrapf(ErrBadScript, "number of %d bytes exceeds %d", len(data), MAX_SCRIPT_NUMBER_SIZE)
+	} else if len(data) > 0 && data[len(data)-1]&0x80 != 0 {
+		return 0, errors.Wrap(ErrBadScript, "negative lock")
+	}
+
+	var number int64
+	for i := len(data) - 1; i >= 0; i-- {
+		number = number<<8 | int64(data[i])
+	}
+	return number, nil
+}
+
+// checkSig verifies a signature, followed by its hash type, over the
+// signature hash of the input. An empty signature is false, any other that
+// does not verify fails the script so that it cannot be swapped for another.
+func (e *scriptEngine) checkSig(signature []byte, pubKey []byte) (bool, error) {
+	if len(signature) == 0 {
+		return false, nil
+	}
+
+	valid, err := e.verifySignature(signature, pubKey)
+	if err != nil {
+		return false, err
+	} else if !valid {
+		return false, errors.Wrap(ErrBadSignature, "signature does not verify")
+	}
+	return true, nil
+}
+
+// checkMultisig pops the number of keys, the keys, the number of required
+// signatures and the signatures, which must match keys in the same order.
+// Like checkSig, only empty signatures may fail without failing the script.
+func (e *scriptEngine) checkMultisig() (bool, error) {
+	pubKeys, err := e.popList(MAX_MULTISIG_KEYS)
+	if err != nil {
+		return false, err
+	}
+
+	e.opCount += len(pubKeys)
+	if e.opCount > MAX_SCRIPT_OPS {
+		return false, errors.Wrapf(ErrBadScript, "script runs more than %d opcodes", MAX_SCRIPT_OPS)
+	}
+
+	signatures, err := e.popList(len(pubKeys))
+	if err != nil {
+		return false, err
+	}
+
+	valid := true
+	next := 0
+	for _, signature := range signatures {
+		matched := false
+		for len(signature) > 0 && !matched && next < len(pubKeys) {
+			matched, err = e.verifySignature(signature, pubKeys[next])
+			if err != nil {
+				return false, err
+			}
+			next++
+		}
+
+		if !matched {
+			valid = false
+			break
+		}
+	}
+
+	if !valid {
+		for _, signature := range signatures {
+			if len(signature) > 0 {
+				return false, errors.Wrap(ErrBadSignature, "multisig signatures do not verify")
+			}
+		}
+	}
+	return valid, nil
+}
+
+// popList pops a count of at most max, pushed with OP_0 to OP_16, then that
+// many items, returned in the order they were pushed.
+func (e *scriptEngine) popList(max int) ([][]byte, error) {
+	countBytes, err := e.pop()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(countBytes) > 1 || (len(countBytes) == 1 && int(countBytes[0]) > max) {
+		return nil, errors.Wrapf(ErrBadScript, "count %x is not between 0 and %d", countBytes, max)
+	}
+
+	count := 0
+	if len(countBytes) == 1 {
+		count = int(countBytes[0])
+	}
+
+	if count > len(e.stack) {
+		return nil, errors.Wrapf(ErrBadScript, "pop of %d items from a stack of %d", count, len(e.stack))
+	}
+
+	items := append([][]byte{}, e.stack[len(e.stack)-count:]...)
+	e.stack = e.stack[:len(e.stack)-count]
+	return items, nil
+}
+
+// verifySignature tells whether a signature, followed by its hash type,
+// signs the signature hash of the input for pubKeyBytes. Malformed
+// signatures and keys are errors.
+func (e *scriptEngine) verifySignature(signature []byte, pubKeyBytes []byte) (bool, error) {
+	pubKey, err := secp256k1.ParsePubKey(pubKeyBytes)
+	if err != nil {
+		return false, errors.Wrapf(ErrBadSignature, "public key: %s", err.Error())
+	}
+
+	sigBytes, hashType, err := splitSignature(signature)
+	if err != nil {
+		return false, errors.Wrap(ErrBadSignature, err.Error())
+	}
+
+	parsed, err := secp256k1.ParseDERSignature(sigBytes, pubKey.Curve)
+	if err != nil {
+		return false, errors.Wrap(ErrBadSignature, err.Error())
+	}
+
+	sigHash, err := e.transaction.SignatureHash(e.txInIndex, e.unspentTxOuts, hashType)
+	if err != nil {
+		return false, errors.Wrap(ErrBadSignature, err.Error())
+	}
+
+	return parsed.Verify(sigHash, pubKey), nil
+}
@@ -0,0 +1,134 @@
+package tx_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func scriptUtxos(address string) tx.UnspentTxOuts {
+	return tx.UnspentTxOuts{{TxOutId: "1", TxOutIndex: 0, Address: address, Amount: 50}}
+}
+
+func spendingTransaction(signature string) *tx.Transaction {
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0, Signature: signature}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 50}},
+	}
+	transaction.Id = transaction.GetTransactionId()
+	return &transaction
+}
+
+func TestPayToPubKeyHash(t *testing.T) {
+	publicKey, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	address, err := tx.PayToPubKeyHashAddress(publicKey)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(address, "76aa20"))
+	assert.True(t, strings.HasSuffix(address, "88ac"))
+
+	utxos := scriptUtxos(address)
+	transaction := signedTransaction(t, utxos, 50)
+	assert.Nil(t, transaction.ValidateTransaction(utxos, 1))
+
+	_, err = transaction.SignTxIn(0, OTHER_PRIVATE_KEY, utxos)
+	assert.NotNil(t, err)
+
+	// The signature of another key does not match the hash.
+	otherPublicKey, err := tx.GetPublicKey(OTHER_PRIVATE_KEY)
+	assert.Nil(t, err)
+	otherAddress, err := tx.PayToPubKeyHashAddress(otherPublicKey)
+	assert.Nil(t, err)
+	otherUtxos := scriptUtxos(otherAddress)
+	otherSigned := spendingTransaction("")
+	signature, err := otherSigned.SignTxIn(0, OTHER_PRIVATE_KEY, otherUtxos)
+	assert.Nil(t, err)
+
+	stolen := spendingTransaction(signature)
+	assert.Equal(t, tx.ErrBadScript, errors.Cause(stolen.ValidateTransaction(utxos, 1)))
+}
+
+func TestScript_UnlockingScriptMustOnlyPush(t *testing.T) {
+	utxos := scriptUtxos(hex.EncodeToString([]byte{tx.OP_1}))
+	assert.Nil(t, spendingTransaction("").ValidateTransaction(utxos, 1))
+
+	transaction := spendingTransaction(hex.EncodeToString([]byte{tx.OP_1, tx.OP_DUP}))
+	assert.Equal(t, tx.ErrBadScript, errors.Cause(transaction.ValidateTransaction(utxos, 1)))
+}
+
+func TestScript_HashLock(t *testing.T) {
+	secret := []byte("open sesame")
+	hash := sha256.Sum256(secret)
+	locking := append([]byte{tx.OP_SHA256, byte(len(hash))}, hash[:]...)
+	locking = append(locking, tx.OP_EQUAL)
+	utxos := scriptUtxos(hex.EncodeToString(locking))
+
+	unlocking := append([]byte{byte(len(secret))}, secret...)
+	assert.Nil(t, spendingTransaction(hex.EncodeToString(unlocking)).ValidateTransaction(utxos, 1))
+
+	wrong := []byte{3, 'a', 'b', 'c'}
+	err := spendingTransaction(hex.EncodeToString(wrong)).ValidateTransaction(utxos, 1)
+	assert.Equal(t, tx.ErrBadScript, errors.Cause(err))
+}
+
+func TestScript_Failures(t *testing.T) {
+	tooManyOps := append([]byte{tx.OP_1}, make([]byte, 0, 300)...)
+	for i := 0; i < tx.MAX_SCRIPT_OPS+1; i++ {
+		tooManyOps = append(tooManyOps, tx.OP_DUP, tx.OP_DROP)
+	}
+
+	tooDeep := []byte{tx.OP_1}
+	for i := 0; i < tx.MAX_STACK_SIZE; i++ {
+		tooDeep = append(tooDeep, tx.OP_DUP)
+	}
+
+	for name, locking := range map[string][]byte{
+		"OP_RETURN":      {tx.OP_RETURN},
+		"empty stack":    {tx.OP_DROP},
+		"false":          {tx.OP_0},
+		"unknown opcode": {0xff},
+		"truncated push": {0x05, 0x01},
+		"too many ops":   tooManyOps,
+		"too deep":       tooDeep,
+		"too large":      make([]byte, tx.MAX_SCRIPT_SIZE+1),
+	} {
+		utxos := scriptUtxos(hex.EncodeToString(locking))
+		err := spendingTransaction("").ValidateTransaction(utxos, 1)
+		assert.Equal(t, tx.ErrBadScript, errors.Cause(err), name)
+	}
+}
+
+func TestParseLockingScript(t *testing.T) {
+	publicKey, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	otherPublicKey, err := tx.GetPublicKey(OTHER_PRIVATE_KEY)
+	assert.Nil(t, err)
+
+	pubKeyHash, err := tx.PayToPubKeyHashAddress(publicKey)
+	assert.Nil(t, err)
+	multisig, err := tx.MultisigAddress(1, []string{publicKey, otherPublicKey})
+	assert.Nil(t, err)
+
+	for _, address := range []string{publicKey, pubKeyHash, multisig} {
+		_, err := tx.ParseLockingScript(address)
+		assert.Nil(t, err)
+		assert.True(t, tx.IsValidAddress(address))
+	}
+
+	// a typo in the key, in the hex or in the script
+	for _, address := range []string{
+		publicKey[:128] + "00",
+		"zz" + pubKeyHash[2:],
+		pubKeyHash[:len(pubKeyHash)-2],
+		"51",
+	} {
+		_, err := tx.ParseLockingScript(address)
+		assert.NotNil(t, err)
+		assert.False(t, tx.IsValidAddress(address))
+	}
+}
@@ -0,0 +1,129 @@
+package tx
+
+import (
+	"crypto/sha256"
+	"strings"
+
+	"github.com/go-naivecoin/wire"
+	"github.com/pkg/errors"
+)
+
+// SigHashType selects the parts of a transaction a signature covers. It is
+// appended to the DER signature as its last byte.
+type SigHashType byte
+
+const (
+	// SIGHASH_ALL signs every input and output.
+	SIGHASH_ALL SigHashType = 0x01
+	// SIGHASH_NONE signs the inputs only, anyone may choose the outputs.
+	SIGHASH_NONE SigHashType = 0x02
+	// SIGHASH_SINGLE signs the inputs and the output at the index of the
+	// signed input.
+	SIGHASH_SINGLE SigHashType = 0x03
+	// SIGHASH_ANYONECANPAY combines with the others to sign the signed input
+	// only, so that others may add theirs.
+	SIGHASH_ANYONECANPAY SigHashType = 0x80
+)
+
+var sigHashNames = map[string]SigHashType{
+	"ALL":    SIGHASH_ALL,
+	"NONE":   SIGHASH_NONE,
+	"SINGLE": SIGHASH_SINGLE,
+}
+
+func (hashType SigHashType) IsValid() bool {
+	base := hashType &^ SIGHASH_ANYONECANPAY
+	return base >= SIGHASH_ALL && base <= SIGHASH_SINGLE
+}
+
+// ParseSigHashType reads ALL, NONE or SINGLE, optionally followed by
+// |ANYONECANPAY. An empty name is ALL.
+func ParseSigHashType(name string) (SigHashType, error) {
+	if name == "" {
+		return SIGHASH_ALL, nil
+	}
+
+	parts := strings.Split(strings.ToUpper(name), "|")
+	hashType, found := sigHashNames[parts[0]]
+	if !found || len(parts) > 2 || (len(parts) == 2 && parts[1] != "ANYONECANPAY") {
+		return 0, errors.Errorf("invalid signature hash type %s", name)
+	}
+
+	if len(parts) == 2 {
+		hashType |= SIGHASH_ANYONECANPAY
+	}
+	return hashType, nil
+}
+
+// SignatureHash returns the hash the signature of input txInIndex signs: the
+// inputs and outputs hashType selects, every input along with the address
+// and amount of the output it spends. With SIGHASH_ANYONECANPAY the position
+// of the input is left out, so that the input may move when others are added
+// before it, and only SIGHASH_SINGLE depends on it to pick its output.
+func (t *Transaction) SignatureHash(txInIndex int, aUnspentTxOuts UnspentTxOuts, hashType SigHashType) ([]byte, error) {
+	if txInIndex < 0 || txInIndex >= len(t.TxIns) {
+		return nil, errors.Errorf("tx %s has no txIn %d", t.Id, txInIndex)
+	} else if !hashType.IsValid() {
+		return nil, errors.Errorf("invalid signature hash type %#x", byte(hashType))
+	}
+
+	var w wire.Writer
+	w.WriteUint32(TX_ENCODING_VERSION)
+	w.WriteUint32(uint32(hashType))
+
+	txIns := t.TxIns
+	if hashType&SIGHASH_ANYONECANPAY != 0 {
+		txIns = t.TxIns[txInIndex : txInIndex+1]
+	} else {
+		w.WriteUvarint(uint64(txInIndex))
+	}
+
+	w.WriteUvarint(uint64(len(txIns)))
+	for _, txIn := range txIns {
+		utxo, found := aUnspentTxOuts.findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex)
+		if !found {
+			return nil, errors.Wrapf(ErrMissingTxOut, "txIn %s:%d", txIn.TxOutId, txIn.TxOutIndex)
+		}
+
+		w.WriteString(txIn.TxOutId)
+		w.WriteInt64(txIn.TxOutIndex)
+		w.WriteInt64(txIn.RelativeLock)
+		w.WriteString(utxo.Address)
+		w.WriteInt64(utxo.Amount)
+	}
+
+	var txOuts []TxOut
+	switch hashType &^ SIGHASH_ANYONECANPAY {
+	case SIGHASH_ALL:
+		txOuts = t.TxOuts
+	case SIGHASH_SINGLE:
+		if txInIndex >= len(t.TxOuts) {
+			return nil, errors.Errorf("tx %s has no txOut %d for SIGHASH_SINGLE", t.Id, txInIndex)
+		}
+		txOuts = t.TxOuts[txInIndex : txInIndex+1]
+	}
+
+	w.WriteUvarint(uint64(len(txOuts)))
+	for _, txOut := range txOuts {
+		txOut.encode(&w)
+	}
+	w.WriteInt64(t.LockTime)
+
+	hash := sha256.Sum256(w.Bytes())
+	return hash[:], nil
+}
+
+// splitSignature returns the DER signature and the hash type of a
+// signature.
+func splitSignature(signature []byte) ([]byte, SigHashType, error) {
+	if len(signature) == 0 {
+		return nil, 0, errors.New("empty signature")
+	}
+
+	hashType := SigHashType(signature[len(signature)-1])
+	if !hashType.IsValid() {
+		return nil, 0, errors.Errorf("invalid signature hash type %#x", byte(hashType))
+	}
+
+	return signature[:len(signature)-1], hashType, nil
+}
@@ -0,0 +1,169 @@
+package tx_test
+
+import (
+	"testing"
+
+	"github.com/go-naivecoin/tx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+const OTHER_PRIVATE_KEY = "1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90a"
+
+func sighashUtxos(t *testing.T) tx.UnspentTxOuts {
+	address, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	otherAddress, err := tx.GetPublicKey(OTHER_PRIVATE_KEY)
+	assert.Nil(t, err)
+
+	return tx.UnspentTxOuts{
+		{TxOutId: "1", TxOutIndex: 0, Address: address, Amount: 30},
+		{TxOutId: "2", TxOutIndex: 0, Address: otherAddress, Amount: 20},
+	}
+}
+
+func signTxIn(t *testing.T, transaction *tx.Transaction, index int64, privateKey string, utxos tx.UnspentTxOuts, hashType tx.SigHashType) {
+	signature, err := transaction.SignTxInWithType(index, privateKey, utxos, hashType)
+	assert.Nil(t, err)
+	transaction.TxIns[index].Signature = signature
+	transaction.Id = transaction.GetTransactionId()
+}
+
+func TestSignatureHash_CoversSpentOutput(t *testing.T) {
+	utxos := sighashUtxos(t)
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 30}},
+	}
+
+	hash, err := transaction.SignatureHash(0, utxos, tx.SIGHASH_ALL)
+	assert.Nil(t, err)
+
+	changed := append(tx.UnspentTxOuts{}, utxos...)
+	changed[0].Amount = 31
+	changedHash, err := transaction.SignatureHash(0, changed, tx.SIGHASH_ALL)
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, changedHash)
+
+	_, err = transaction.SignatureHash(0, utxos[1:], tx.SIGHASH_ALL)
+	assert.Equal(t, tx.ErrMissingTxOut, errors.Cause(err))
+}
+
+func TestSignatureHash_All_RejectsChangedOutputs(t *testing.T) {
+	utxos := sighashUtxos(t)
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 30}},
+	}
+	signTxIn(t, &transaction, 0, PRIVATE_KEY, utxos, tx.SIGHASH_ALL)
+	assert.Nil(t, transaction.ValidateTransaction(utxos, 1))
+
+	transaction.TxOuts = []tx.TxOut{{Address: utxos[0].Address, Amount: 30}}
+	transaction.Id = transaction.GetTransactionId()
+	assert.Equal(t, tx.ErrBadSignature, errors.Cause(transaction.ValidateTransaction(utxos, 1)))
+}
+
+func TestSignatureHash_None_AllowsChangedOutputs(t *testing.T) {
+	utxos := sighashUtxos(t)
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 30}},
+	}
+	signTxIn(t, &transaction, 0, PRIVATE_KEY, utxos, tx.SIGHASH_NONE)
+
+	transaction.TxOuts = []tx.TxOut{{Address: utxos[1].Address, Amount: 30}}
+	transaction.Id = transaction.GetTransactionId()
+	assert.Nil(t, transaction.ValidateTransaction(utxos, 1))
+}
+
+func TestSignatureHash_Single(t *testing.T) {
+	utxos := sighashUtxos(t)
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}, {TxOutId: "2", TxOutIndex: 0}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 30}, {Address: ADDRESS, Amount: 20}},
+	}
+	signTxIn(t, &transaction, 0, PRIVATE_KEY, utxos, tx.SIGHASH_SINGLE)
+	signTxIn(t, &transaction, 1, OTHER_PRIVATE_KEY, utxos, tx.SIGHASH_ALL)
+	assert.Nil(t, transaction.ValidateTransaction(utxos, 1))
+
+	// Only the second signature covers the second output.
+	transaction.TxOuts[1].Address = utxos[1].Address
+	transaction.Id = transaction.GetTransactionId()
+	err := transaction.ValidateTransaction(utxos, 1)
+	assert.Equal(t, tx.ErrBadSignature, errors.Cause(err))
+	assert.Contains(t, err.Error(), "txIn 2:0")
+
+	transaction.TxOuts = transaction.TxOuts[:1]
+	_, err = transaction.SignatureHash(1, utxos, tx.SIGHASH_SINGLE)
+	assert.NotNil(t, err)
+}
+
+func TestSignatureHash_AnyoneCanPay_AllowsAddedInputs(t *testing.T) {
+	utxos := sighashUtxos(t)
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 50}},
+	}
+	signTxIn(t, &transaction, 0, PRIVATE_KEY, utxos, tx.SIGHASH_ALL|tx.SIGHASH_ANYONECANPAY)
+
+	transaction.TxIns = append(transaction.TxIns, tx.TxIn{TxOutId: "2", TxOutIndex: 0})
+	signTxIn(t, &transaction, 1, OTHER_PRIVATE_KEY, utxos, tx.SIGHASH_ALL|tx.SIGHASH_ANYONECANPAY)
+	assert.Nil(t, transaction.ValidateTransaction(utxos, 1))
+}
+
+func TestSignatureHash_InvalidType(t *testing.T) {
+	utxos := sighashUtxos(t)
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 30}},
+	}
+
+	_, err := transaction.SignTxInWithType(0, PRIVATE_KEY, utxos, tx.SIGHASH_ANYONECANPAY)
+	assert.NotNil(t, err)
+
+	signTxIn(t, &transaction, 0, PRIVATE_KEY, utxos, tx.SIGHASH_ALL)
+	signature := transaction.TxIns[0].Signature
+	transaction.TxIns[0].Signature = signature[:len(signature)-2] + "04"
+	transaction.Id = transaction.GetTransactionId()
+	assert.Equal(t, tx.ErrBadSignature, errors.Cause(transaction.ValidateTransaction(utxos, 1)))
+}
+
+func TestParseSigHashType(t *testing.T) {
+	for name, expected := range map[string]tx.SigHashType{
+		"":                    tx.SIGHASH_ALL,
+		"ALL":                 tx.SIGHASH_ALL,
+		"none":                tx.SIGHASH_NONE,
+		"SINGLE|ANYONECANPAY": tx.SIGHASH_SINGLE | tx.SIGHASH_ANYONECANPAY,
+	} {
+		hashType, err := tx.ParseSigHashType(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, hashType)
+	}
+
+	for _, name := range []string{"ANYONECANPAY", "ALL|NONE", "ALL|ANYONECANPAY|X"} {
+		_, err := tx.ParseSigHashType(name)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestSignatureHash_AnyoneCanPay_AllowsMovedInput(t *testing.T) {
+	utxos := sighashUtxos(t)
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 50}},
+	}
+	signTxIn(t, &transaction, 0, PRIVATE_KEY, utxos, tx.SIGHASH_ALL|tx.SIGHASH_ANYONECANPAY)
+
+	// another contributor adds an input before the signed one
+	transaction.TxIns = append([]tx.TxIn{{TxOutId: "2", TxOutIndex: 0}}, transaction.TxIns...)
+	signTxIn(t, &transaction, 0, OTHER_PRIVATE_KEY, utxos, tx.SIGHASH_ALL|tx.SIGHASH_ANYONECANPAY)
+	assert.Nil(t, transaction.ValidateTransaction(utxos, 1))
+
+	// without ANYONECANPAY the position is signed
+	moved, err := transaction.SignatureHash(1, utxos, tx.SIGHASH_ALL)
+	assert.Nil(t, err)
+	transaction.TxIns[0], transaction.TxIns[1] = transaction.TxIns[1], transaction.TxIns[0]
+	unmoved, err := transaction.SignatureHash(0, utxos, tx.SIGHASH_ALL)
+	assert.Nil(t, err)
+	assert.NotEqual(t, moved, unmoved)
+}
@@ -4,13 +4,12 @@ import (
 	. "github.com/ahmetb/go-linq"
 	"fmt"
 	"crypto/sha256"
-	"encoding/json"
 	"github.com/pkg/errors"
 	"encoding/hex"
 	"github.com/decred/dcrd/dcrec/secp256k1"
-	"regexp"
-	"strings"
 	"log"
+	"github.com/go-naivecoin/params"
+	"github.com/go-naivecoin/wire"
 )
 
 type UnspentTxOut struct {
@@ -18,6 +17,15 @@ type UnspentTxOut struct {
 	TxOutIndex int64  `json:"txOutIndex"`
 	Address    string `json:"address"`
 	Amount     int64  `json:"amount"`
+	// BlockHeight is the height of the block that created the output.
+	BlockHeight int64 `json:"blockHeight"`
+	IsCoinbase  bool  `json:"isCoinbase"`
+}
+
+// IsMature tells whether the output may be spent in the block at
+// spendHeight: coinbase outputs wait for params CoinbaseMaturity blocks.
+func (utxo UnspentTxOut) IsMature(spendHeight int64) bool {
+	return !utxo.IsCoinbase || spendHeight-utxo.BlockHeight >= params.Active().CoinbaseMaturity
 }
 
 type UnspentTxOuts []UnspentTxOut
@@ -34,43 +42,42 @@ func (utxos UnspentTxOuts) findUnspentTxOut(transactionId string, index int64) (
 type TxIn struct {
 	TxOutId    string `json:"txOutId"`
 	TxOutIndex int64  `json:"txOutIndex"`
-	Signature  string `json:"signature"`
+	// RelativeLock is the number of blocks the spent output must have been
+	// confirmed for, counting its own.
+	RelativeLock int64 `json:"relativeLock"`
+	// Signature is the unlocking script of the spent output in hex, or the
+	// bare signature when the output pays to a public key.
+	Signature string `json:"signature"`
 }
 
-func (txIn *TxIn) validateTxIn(transaction *Transaction, aUnspentTxOuts UnspentTxOuts) bool {
+func (t *Transaction) validateTxIn(txInIndex int, aUnspentTxOuts UnspentTxOuts, spendHeight int64) error {
+	txIn := t.TxIns[txInIndex]
 	utxo, found := aUnspentTxOuts.findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex)
 	if !found {
-		bytes, _ := json.Marshal(txIn)
-		log.Printf("referenced txOut not found: %s", string(bytes[:]))
-		return false
+		return errors.Wrapf(ErrMissingTxOut, "txIn %s:%d", txIn.TxOutId, txIn.TxOutIndex)
 	}
 
-	pubKeyBytes, err := hex.DecodeString(utxo.Address)
-	if err != nil {
-		log.Printf("%s", err.Error())
-		return false
+	if !utxo.IsMature(spendHeight) {
+		return errors.Wrapf(ErrImmatureCoinbase, "txOut %s of block %d at height %d", utxo.TxOutId, utxo.BlockHeight, spendHeight)
 	}
 
-	pubKey, err := secp256k1.ParsePubKey(pubKeyBytes)
-	if err != nil {
-		log.Printf("%s", err.Error())
-		return false
+	if !txIn.isUnlocked(utxo, spendHeight) {
+		return errors.Wrapf(ErrLocked, "txIn %s:%d is locked for %d blocks after block %d", txIn.TxOutId, txIn.TxOutIndex, txIn.RelativeLock, utxo.BlockHeight)
 	}
 
-	sigBytes, err := hex.DecodeString(txIn.Signature)
-	if err != nil {
-		log.Printf("%s", err.Error())
-		return false
+	if err := t.verifyTxInScript(txInIndex, utxo, aUnspentTxOuts); err != nil {
+		return errors.Wrapf(err, "txIn %s:%d", txIn.TxOutId, txIn.TxOutIndex)
 	}
 
-	signature, err := secp256k1.ParseDERSignature(sigBytes, pubKey.Curve)
-	if err != nil {
-		log.Printf("%s", err.Error())
-		return false
-	}
+	return nil
+}
 
-	return signature.Verify([]byte(transaction.Id), pubKey)
+// isUnlocked tells whether the relative lock of txIn has expired in the
+// block at spendHeight.
+func (txIn TxIn) isUnlocked(utxo UnspentTxOut, spendHeight int64) bool {
+	return txIn.RelativeLock >= 0 && spendHeight-utxo.BlockHeight >= txIn.RelativeLock
 }
+
 func (txIn *TxIn) getTxInAmount(aUnspentTxOuts UnspentTxOuts) int64 {
 	utxo, found := aUnspentTxOuts.findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex)
 	if !found {
@@ -80,127 +87,169 @@ func (txIn *TxIn) getTxInAmount(aUnspentTxOuts UnspentTxOuts) int64 {
 	return utxo.Amount
 }
 
+// TxOut pays Amount to Address: a public key, or the locking script of the
+// output in hex.
 type TxOut struct {
 	Address string `json:"address"`
 	Amount  int64  `json:"amount"`
 }
 
+// MAX_MONEY bounds every amount, see params.MAX_MONEY.
+const MAX_MONEY = params.MAX_MONEY
+
+// addAmount returns total plus amount, both of which must lie between 0 and
+// MAX_MONEY, as long as the sum does too.
+func addAmount(total int64, amount int64) (int64, error) {
+	if amount < 0 {
+		return 0, errors.Wrapf(ErrNegativeAmount, "amount %d", amount)
+	} else if amount > MAX_MONEY || total > MAX_MONEY-amount {
+		return 0, errors.Wrapf(ErrAmountOutOfRange, "%d plus %d exceeds %d", total, amount, MAX_MONEY)
+	}
+	return total + amount, nil
+}
+
+// LOCKTIME_THRESHOLD splits lock times: below it they are block heights,
+// from it on unix times.
+const LOCKTIME_THRESHOLD = 500000000
+
 type Transaction struct {
 	Id     string  `json:"id"`
 	TxIns  []TxIn  `json:"txIns"`
 	TxOuts []TxOut `json:"txOuts"`
+	// LockTime is the first block height, or the median time past of the
+	// parent block, from which the transaction may be included. 0 does not
+	// lock it.
+	LockTime int64 `json:"lockTime"`
 }
 
-const COINBASE_AMOUNT int64 = 50
+// IsFinal tells whether the lock time of the transaction allows it in the
+// block at blockHeight, whose parent has medianTime as its median time past.
+func (t *Transaction) IsFinal(blockHeight int64, medianTime int64) bool {
+	if t.LockTime < LOCKTIME_THRESHOLD {
+		return t.LockTime <= blockHeight
+	}
+	return t.LockTime <= medianTime
+}
 
-// todo: this may need refine
+// GetTransactionId hashes the binary encoding of the transaction without
+// its signatures, so that signing does not change the id.
 func (t *Transaction) GetTransactionId() string {
-	txInContent := From(t.TxIns).Select(func(i interface{}) interface{} {
-		txIn := i.(TxIn)
-		return fmt.Sprintf("%s%d", txIn.TxOutId, txIn.TxOutIndex)
-	}).AggregateWithSeed("", func(i interface{}, i2 interface{}) interface{} {
-		iStr := i.(string)
-		i2Str := i2.(string)
-		return iStr + i2Str
-	}).(string)
-
-	txOutContent := From(t.TxOuts).Select(func(i interface{}) interface{} {
-		txOut := i.(TxOut)
-		return fmt.Sprintf("%s%d", txOut.Address, txOut.Amount)
-	}).AggregateWithSeed("", func(i interface{}, i2 interface{}) interface{} {
-		iStr := i.(string)
-		i2Str := i2.(string)
-		return iStr + i2Str
-	}).(string)
-
-	hashStr := fmt.Sprintf("%s%s", txInContent, txOutContent)
-	bytes := sha256.Sum256([]byte(hashStr))
+	var w wire.Writer
+	t.encode(&w, false)
+	bytes := sha256.Sum256(w.Bytes())
 	return fmt.Sprintf("%x", bytes)
 }
 
-func (t *Transaction) ValidateTransaction(aUnspentTxOuts UnspentTxOuts) bool {
+// ValidateTransaction checks the transaction against the unspent transaction
+// outputs, for inclusion in the block at spendHeight.
+func (t *Transaction) ValidateTransaction(aUnspentTxOuts UnspentTxOuts, spendHeight int64) error {
 	if t.GetTransactionId() != t.Id {
-		log.Printf("Invalid tx id： %s", t.Id)
+		return errors.Wrapf(ErrBadTxId, "tx %s", t.Id)
 	}
 
-	hasValidTxIns := From(t.TxIns).Select(func(i interface{}) interface{} {
-		txIn := i.(TxIn)
-		return txIn.validateTxIn(t, aUnspentTxOuts)
-	}).AggregateWithSeed(true, func(i interface{}, i2 interface{}) interface{} {
-		validate1 := i.(bool)
-		validate2 := i2.(bool)
-		return validate1 && validate2
-	}).(bool)
-
-	if !hasValidTxIns {
-		log.Printf("some of the txIns are invalid in tx: %s", t.Id)
-		return false
+	for i := range t.TxIns {
+		if err := t.validateTxIn(i, aUnspentTxOuts, spendHeight); err != nil {
+			return errors.Wrapf(err, "tx %s", t.Id)
+		}
 	}
 
-	totalTxInValues := From(t.TxIns).Select(func(i interface{}) interface{} {
-		txIn := i.(TxIn)
-		return txIn.getTxInAmount(aUnspentTxOuts)
-	}).AggregateWithSeed(int64(0), func(i interface{}, i2 interface{}) interface{} {
-		amount1 := i.(int64)
-		amount2 := i2.(int64)
-		return amount1 + amount2
-	}).(int64)
-
-	totalTxOutValues := From(t.TxOuts).Select(func(i interface{}) interface{} {
-		txOut := i.(TxOut)
-		return txOut.Amount
-	}).AggregateWithSeed(int64(0), func(i interface{}, i2 interface{}) interface{} {
-		amount1 := i.(int64)
-		amount2 := i2.(int64)
-		return amount1 + amount2
-	}).(int64)
-
-	if totalTxInValues != totalTxOutValues {
-		log.Printf("totalTxInValues != totalTxOutValues in tx: %s", t.Id)
-		return false
+	fee, err := t.GetFee(aUnspentTxOuts)
+	if err != nil {
+		return errors.Wrapf(err, "tx %s", t.Id)
 	}
 
-	return true
+	if fee < 0 {
+		return errors.Wrapf(ErrInputsOutputsMismatch, "tx %s is short of %d", t.Id, -fee)
+	}
+
+	return nil
+}
+
+// GetFee returns what the inputs of the transaction are worth above its
+// outputs, which the miner of its block may claim. It fails when an amount,
+// or the sum of the inputs or of the outputs, is out of the money range.
+func (t *Transaction) GetFee(aUnspentTxOuts UnspentTxOuts) (int64, error) {
+	var totalTxInValues int64
+	for i := range t.TxIns {
+		total, err := addAmount(totalTxInValues, t.TxIns[i].getTxInAmount(aUnspentTxOuts))
+		if err != nil {
+			return 0, errors.Wrapf(err, "txIn %d", i)
+		}
+		totalTxInValues = total
+	}
+
+	var totalTxOutValues int64
+	for i, txOut := range t.TxOuts {
+		total, err := addAmount(totalTxOutValues, txOut.Amount)
+		if err != nil {
+			return 0, errors.Wrapf(err, "txOut %d", i)
+		}
+		totalTxOutValues = total
+	}
+
+	return totalTxInValues - totalTxOutValues, nil
 }
 
-func (t *Transaction) validateCoinbaseTx(blockIndex int64) bool {
+// GetTotalFees returns the fees of all the transactions, none of which may
+// be a coinbase transaction.
+func GetTotalFees(transactions []Transaction, aUnspentTxOuts UnspentTxOuts) (int64, error) {
+	var fees int64
+	for i := range transactions {
+		fee, err := transactions[i].GetFee(aUnspentTxOuts)
+		if err != nil {
+			return 0, errors.Wrapf(err, "tx %s", transactions[i].Id)
+		}
+
+		if fees, err = addAmount(fees, fee); err != nil {
+			return 0, errors.Wrapf(err, "fee of tx %s", transactions[i].Id)
+		}
+	}
+	return fees, nil
+}
+
+func (t *Transaction) validateCoinbaseTx(blockIndex int64, fees int64) error {
 	if t.GetTransactionId() != t.Id {
-		log.Printf("invalid coinbase tx id: %s", t.Id)
-		return false
+		return errors.Wrapf(ErrBadTxId, "coinbase tx %s", t.Id)
 	}
 
 	if len(t.TxIns) != 1 {
-		log.Printf("one txIn must be specified in the coinbase transaction")
-		return false
+		return errors.Wrap(ErrBadCoinbase, "one txIn must be specified in the coinbase transaction")
 	}
 
 	if t.TxIns[0].TxOutIndex != blockIndex {
-		log.Printf("the txIn Signature in coinbase tx must be the block height")
-		return false
+		return errors.Wrap(ErrBadCoinbase, "the txIn Signature in coinbase tx must be the block height")
 	}
 
 	if len(t.TxOuts) != 1 {
-		log.Printf("invalid number of txOuts in coinbase transaction")
-		return false
+		return errors.Wrap(ErrBadCoinbase, "invalid number of txOuts in coinbase transaction")
 	}
 
-	if t.TxOuts[0].Amount != COINBASE_AMOUNT {
-		log.Printf("invalid coinbase amount in coinbase transaction")
-		return false
+	maxAmount, err := addAmount(params.Active().BlockSubsidy(blockIndex), fees)
+	if err != nil {
+		return errors.Wrap(err, "coinbase subsidy and fees")
 	}
 
-	return true
+	if t.TxOuts[0].Amount < 0 || t.TxOuts[0].Amount > maxAmount {
+		return errors.Wrapf(ErrBadCoinbase, "coinbase amount %d is not between 0 and %d", t.TxOuts[0].Amount, maxAmount)
+	}
+
+	return nil
 }
 
+// SignTxIn signs input txInIndex with SIGHASH_ALL, see SignTxInWithType.
 func (t *Transaction) SignTxIn(txInIndex int64, privateKey string, aUnspentTxOuts UnspentTxOuts) (string, error) {
+	return t.SignTxInWithType(txInIndex, privateKey, aUnspentTxOuts, SIGHASH_ALL)
+}
 
+// SignTxInWithType returns the TxIn Signature of input txInIndex, covering
+// what hashType selects, when the output it spends pays to the public key of
+// privateKey or to its hash.
+func (t *Transaction) SignTxInWithType(txInIndex int64, privateKey string, aUnspentTxOuts UnspentTxOuts, hashType SigHashType) (string, error) {
 	txIn := t.TxIns[txInIndex]
-	dataToSign := []byte(t.Id)
 
 	utxo, found := aUnspentTxOuts.findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex)
 	if !found {
-		log.Printf("could not find referenced txOut")
-		panic(t)
+		return "", errors.Wrapf(ErrMissingTxOut, "SignTxIn- txIn %s:%d", txIn.TxOutId, txIn.TxOutIndex)
 	}
 
 	skBytes, err := hex.DecodeString(privateKey)
@@ -215,18 +264,33 @@ func (t *Transaction) SignTxIn(txInIndex int64, privateKey string, aUnspentTxOut
 
 	publicKey := hex.EncodeToString(pbBytes)
 
-	if publicKey != utxo.Address {
+	pubKeyHashAddress, err := PayToPubKeyHashAddress(publicKey)
+	if err != nil {
+		return "", errors.Wrap(err, "SignTxIn- PayToPubKeyHashAddress")
+	}
+
+	if publicKey != utxo.Address && pubKeyHashAddress != utxo.Address {
 		return "", errors.New("trying to sign an input with private key that does not match the address that is referenced in txIn")
 	}
 
-	signature, err := privKey.Sign(dataToSign)
+	sigHash, err := t.SignatureHash(int(txInIndex), aUnspentTxOuts, hashType)
+	if err != nil {
+		return "", errors.Wrap(err, "SignTxIn- SignatureHash")
+	}
+
+	signature, err := privKey.Sign(sigHash)
 
 	if err != nil {
 		log.Printf("%s" ,err.Error())
 		return "", errors.Wrap(err, "SignTxIn- privKey.Sign")
 	}
 
-	return hex.EncodeToString(signature.Serialize()), nil
+	sigBytes := append(signature.Serialize(), byte(hashType))
+	if utxo.Address == publicKey {
+		return hex.EncodeToString(sigBytes), nil
+	}
+
+	return hex.EncodeToString(pushData(pushData(nil, sigBytes), pbBytes)), nil
 }
 
 func GetPublicKey(privateKey string) (string, error) {
@@ -240,13 +304,16 @@ func GetPublicKey(privateKey string) (string, error) {
 	return hex.EncodeToString(pubKey.SerializeUncompressed()), nil
 }
 
-func validateBlockTransactions(aTransactions []Transaction, aUnspentTxOuts UnspentTxOuts, blockIndex int64) bool {
+func validateBlockTransactions(aTransactions []Transaction, aUnspentTxOuts UnspentTxOuts, blockIndex int64, medianTime int64) error {
+	if len(aTransactions) == 0 {
+		return errors.Wrap(ErrBadCoinbase, "block has no transactions")
+	}
 	coinbaseTx := aTransactions[0]
 
-	if !coinbaseTx.validateCoinbaseTx(blockIndex) {
-		bytes, _ := json.Marshal(coinbaseTx)
-		log.Printf("invalid coinbase transaction: %s", string(bytes[:]))
-		return false
+	for i := range aTransactions {
+		if !aTransactions[i].IsFinal(blockIndex, medianTime) {
+			return errors.Wrapf(ErrLocked, "tx %s is locked until %d", aTransactions[i].Id, aTransactions[i].LockTime)
+		}
 	}
 
 	var txIns []TxIn
@@ -261,39 +328,42 @@ func validateBlockTransactions(aTransactions []Transaction, aUnspentTxOuts Unspe
 	}).Count()
 
 	if distinctedLen != len(txIns) {
-		log.Printf("Has duplicated transaction")
-		return false
+		return errors.Wrap(ErrDoubleSpend, "block spends the same txOut twice")
 	}
 
 	normalTransactions := aTransactions[1:]
+	for i := range normalTransactions {
+		if err := normalTransactions[i].ValidateTransaction(aUnspentTxOuts, blockIndex); err != nil {
+			return err
+		}
+	}
 
-	isValid := From(normalTransactions).Select(func(i interface{}) interface{} {
-		t := i.(Transaction)
-		return t.ValidateTransaction(aUnspentTxOuts)
-	}).AggregateWithSeed(true, func(i interface{}, i2 interface{}) interface{} {
-		b := i.(bool)
-		b2 := i2.(bool)
-		return b && b2
-	}).(bool)
-
-	return isValid
+	fees, err := GetTotalFees(normalTransactions, aUnspentTxOuts)
+	if err != nil {
+		return err
+	}
+	return coinbaseTx.validateCoinbaseTx(blockIndex, fees)
 }
 
-func ProcessTransactions(newTransactions []Transaction, aUnspentTxOuts UnspentTxOuts, blockIndex int64) (UnspentTxOuts, error) {
-	if !validateBlockTransactions(newTransactions, aUnspentTxOuts, blockIndex) {
-		log.Printf("invalid block transactions")
-		return nil, errors.New("invalid block transactions")
+// ProcessTransactions validates the transactions of the block at blockIndex,
+// whose parent has medianTime as its median time past, and returns the
+// unspent transaction outputs after them.
+func ProcessTransactions(newTransactions []Transaction, aUnspentTxOuts UnspentTxOuts, blockIndex int64, medianTime int64) (UnspentTxOuts, error) {
+	if err := validateBlockTransactions(newTransactions, aUnspentTxOuts, blockIndex, medianTime); err != nil {
+		return nil, errors.Wrap(err, "invalid block transactions")
 	}
 
-	newUnspentTxOutsQuery := From(newTransactions).SelectMany(func(i interface{}) Query {
+	newUnspentTxOutsQuery := From(newTransactions).SelectManyIndexed(func(txIndex int, i interface{}) Query {
 		transaction := i.(Transaction)
 		return From(transaction.TxOuts).SelectIndexed(func(index int, txOutI interface{}) interface{} {
 			txOut := txOutI.(TxOut)
 			utxo := UnspentTxOut{
-				TxOutId:    transaction.Id,
-				TxOutIndex: int64(index),
-				Address:    txOut.Address,
-				Amount:     txOut.Amount,
+				TxOutId:     transaction.Id,
+				TxOutIndex:  int64(index),
+				Address:     txOut.Address,
+				Amount:      txOut.Amount,
+				BlockHeight: blockIndex,
+				IsCoinbase:  txIndex == 0,
 			}
 			return utxo
 		})
@@ -326,13 +396,59 @@ func ProcessTransactions(newTransactions []Transaction, aUnspentTxOuts UnspentTx
 	return resultingUnspentTxOuts, nil
 }
 
+// GetSpentTxOuts returns the unspent transaction outputs consumed by the
+// given transactions, which is what RevertTransactions needs to undo them.
+func GetSpentTxOuts(transactions []Transaction, aUnspentTxOuts UnspentTxOuts) UnspentTxOuts {
+	var spentTxOuts UnspentTxOuts
+
+	From(transactions).SelectMany(func(t interface{}) Query {
+		transaction := t.(Transaction)
+		return From(transaction.TxIns)
+	}).Select(func(i interface{}) interface{} {
+		txIn := i.(TxIn)
+		utxo, _ := aUnspentTxOuts.findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex)
+		return utxo
+	}).Where(func(i interface{}) bool {
+		utxo := i.(UnspentTxOut)
+		return utxo.TxOutId != ""
+	}).ToSlice(&spentTxOuts)
+
+	return spentTxOuts
+}
+
+// RevertTransactions undoes ProcessTransactions: the outputs created by the
+// transactions are removed and the spent ones are restored.
+func RevertTransactions(transactions []Transaction, aUnspentTxOuts UnspentTxOuts, spentTxOuts UnspentTxOuts) UnspentTxOuts {
+	createdIds := From(transactions).Select(func(i interface{}) interface{} {
+		transaction := i.(Transaction)
+		return transaction.Id
+	})
+
+	var resultingUnspentTxOuts UnspentTxOuts
+
+	From(aUnspentTxOuts).Where(func(i interface{}) bool {
+		utxo := i.(UnspentTxOut)
+		return !createdIds.Contains(utxo.TxOutId)
+	}).Concat(From(spentTxOuts)).ToSlice(&resultingUnspentTxOuts)
+
+	return resultingUnspentTxOuts
+}
+
 func GetCoinbaseTransaction(address string, blockIndex int64) Transaction {
+	return GetCoinbaseTransactionWithFees(address, blockIndex, 0)
+}
+
+// GetCoinbaseTransactionWithFees returns the coinbase transaction paying the
+// subsidy at blockIndex along with the fees of the other transactions of the
+// block.
+func GetCoinbaseTransactionWithFees(address string, blockIndex int64, fees int64) Transaction {
 	var txIn TxIn = TxIn{TxOutIndex: blockIndex}
-	var txOut TxOut = TxOut{Address: address, Amount: COINBASE_AMOUNT}
+	var txOut TxOut = TxOut{Address: address, Amount: params.Active().BlockSubsidy(blockIndex) + fees}
 	var transaction Transaction = Transaction{
 		"",
 		[]TxIn{txIn},
 		[]TxOut{txOut},
+		0,
 	}
 
 	transaction.Id = transaction.GetTransactionId()
@@ -341,14 +457,8 @@ func GetCoinbaseTransaction(address string, blockIndex int64) Transaction {
 }
 
 func IsValidAddress(address string) bool {
-	if len(address) != 130 {
-		log.Printf("invalid public key length")
-		return false
-	} else if matched, _ := regexp.MatchString("^[a-fA-F0-9]+$", address); !matched {
-		log.Printf("public key must contain only hex characters'")
-		return false
-	} else if !strings.HasPrefix(address, "04") {
-		log.Printf("public key must start with 04'")
+	if _, err := ParseLockingScript(address); err != nil {
+		log.Printf("invalid address: %s", err.Error())
 		return false
 	}
 	return true
@@ -5,30 +5,53 @@ import (
 	"bytes"
 	"github.com/pkg/errors"
 	"log"
+	"sync"
 	. "github.com/ahmetb/go-linq"
 )
 
 type TransactionPool []Transaction
 
+// poolMutex guards transactionPool, which the miner, the peers and the http
+// handlers reach from their own goroutines.
+var poolMutex sync.Mutex
 var transactionPool TransactionPool = make(TransactionPool, 0)
 
 func GetTransactionPool() TransactionPool {
 	var theTranactionPool TransactionPool
 
 	var buff bytes.Buffer
+	poolMutex.Lock()
 	gob.NewEncoder(&buff).Encode(transactionPool)
+	poolMutex.Unlock()
 	gob.NewDecoder(bytes.NewBuffer(buff.Bytes())).Decode(&theTranactionPool)
 
 	return theTranactionPool
 }
 
-func AddToTransactionPool(tx *Transaction, unspentTxOuts UnspentTxOuts) (bool, error) {
-	if !tx.ValidateTransaction(unspentTxOuts) {
-		return false, errors.New("Trying to add invalid tx to pool")
+// AddToTransactionPool adds the transaction if it is valid for the block at
+// spendHeight, the one following the tip whose median time past is
+// medianTime.
+func AddToTransactionPool(tx *Transaction, unspentTxOuts UnspentTxOuts, spendHeight int64, medianTime int64) (bool, error) {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
+	known := From(transactionPool).AnyWith(func(i interface{}) bool {
+		return i.(Transaction).Id == tx.Id
+	})
+	if known {
+		return false, errors.Wrapf(ErrKnownTransaction, "tx %s", tx.Id)
+	}
+
+	if !tx.IsFinal(spendHeight, medianTime) {
+		return false, errors.Wrapf(ErrLocked, "tx %s is locked until %d", tx.Id, tx.LockTime)
+	}
+
+	if err := tx.ValidateTransaction(unspentTxOuts, spendHeight); err != nil {
+		return false, err
 	}
 
 	if !IsValidTxForPool(tx, transactionPool) {
-		return false, errors.New("Trying to add invalid tx to pool")
+		return false, errors.Wrapf(ErrDoubleSpend, "tx %s spends a txOut already spent in the pool", tx.Id)
 	}
 
 	transactionPool = append(transactionPool, *tx)
@@ -36,17 +59,33 @@ func AddToTransactionPool(tx *Transaction, unspentTxOuts UnspentTxOuts) (bool, e
 	return true, nil
 }
 
-func UpdateTransactionPool(unspentTxOuts UnspentTxOuts) {
+// ReturnToTransactionPool puts the transactions of a disconnected block back
+// into the pool. Those no longer valid against unspentTxOuts are dropped.
+func ReturnToTransactionPool(transactions []Transaction, unspentTxOuts UnspentTxOuts, spendHeight int64, medianTime int64) {
+	for i := range transactions {
+		if _, err := AddToTransactionPool(&transactions[i], unspentTxOuts, spendHeight, medianTime); err != nil {
+			log.Printf("dropping transaction %s of disconnected block: %s", transactions[i].Id, err.Error())
+		}
+	}
+}
+
+// UpdateTransactionPool drops the transactions spending outputs that are no
+// longer unspent, or that are not mature or unlocked at spendHeight after a
+// block was disconnected.
+func UpdateTransactionPool(unspentTxOuts UnspentTxOuts, spendHeight int64, medianTime int64) {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+
 	var invalidTxs []Transaction
 	From(transactionPool).Where(func(i interface{}) bool {
 		tx := i.(Transaction)
 		_, foundInvalidTX := From(tx.TxIns).FirstWith(func(j interface{}) bool {
 			txIn := j.(TxIn)
-			_, foundUTXO := unspentTxOuts.findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex)
-			return !foundUTXO
+			utxo, foundUTXO := unspentTxOuts.findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex)
+			return !foundUTXO || !utxo.IsMature(spendHeight) || !txIn.isUnlocked(utxo, spendHeight)
 		}).(TxIn)
 
-		return foundInvalidTX
+		return foundInvalidTX || !tx.IsFinal(spendHeight, medianTime)
 	}).ToSlice(&invalidTxs)
 
 	if len(invalidTxs) > 0 {
@@ -66,7 +105,7 @@ func UpdateTransactionPool(unspentTxOuts UnspentTxOuts) {
 func (t TransactionPool) GetTxPoolIns() []TxIn {
 	var txIns []TxIn
 
-	From(transactionPool).SelectMany(func(i interface{}) Query {
+	From(t).SelectMany(func(i interface{}) Query {
 		tx := i.(Transaction)
 		return From(tx.TxIns)
 	}).ToSlice(&txIns)
@@ -6,6 +6,8 @@ import (
 	"github.com/go-naivecoin/tx"
 	"encoding/hex"
 	"github.com/decred/dcrd/dcrec/secp256k1"
+	"github.com/pkg/errors"
+	"math"
 )
 
 const (
@@ -17,7 +19,7 @@ func TestGetCoinbaseTransaction(t *testing.T) {
 
 	transation := tx.GetCoinbaseTransaction(ADDRESS, 1)
 
-	assert.Equal(t, "18105ee60d728d4ad229a15f5e76c396992f2d7ab4ddceaac77145d1843c17df", transation.Id)
+	assert.Equal(t, "6d1e56369783fc7f76ca77e740c098f02d1a22b3043e5af6f1e0966671838034", transation.Id)
 }
 
 func TestVerifyLogic(t *testing.T)  {
@@ -37,3 +39,114 @@ func TestVerifyLogic(t *testing.T)  {
 	res := signature.Verify([]byte("180ce43a30b8071b7548858ea419524c3bc6493e3d540b91b9f8e748e9c31614"), pubKey)
 	assert.True(t, res)
 }
+
+const PRIVATE_KEY = "0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+
+func signedTransaction(t *testing.T, utxos tx.UnspentTxOuts, amount int64) tx.Transaction {
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: utxos[0].TxOutId, TxOutIndex: utxos[0].TxOutIndex}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: amount}},
+	}
+	transaction.Id = transaction.GetTransactionId()
+
+	signature, err := transaction.SignTxIn(0, PRIVATE_KEY, utxos)
+	assert.Nil(t, err)
+	transaction.TxIns[0].Signature = signature
+	return transaction
+}
+
+func TestValidateTransaction_ThenTypedErrors(t *testing.T) {
+	address, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	utxos := tx.UnspentTxOuts{{TxOutId: "1", TxOutIndex: 0, Address: address, Amount: 50}}
+
+	valid := signedTransaction(t, utxos, 50)
+	assert.Nil(t, valid.ValidateTransaction(utxos, 1))
+
+	overspending := signedTransaction(t, utxos, 60)
+	assert.Equal(t, tx.ErrInputsOutputsMismatch, errors.Cause(overspending.ValidateTransaction(utxos, 1)))
+
+	tampered := valid
+	tampered.TxOuts = []tx.TxOut{{Address: address, Amount: 50}}
+	assert.Equal(t, tx.ErrBadTxId, errors.Cause(tampered.ValidateTransaction(utxos, 1)))
+
+	tampered.Id = tampered.GetTransactionId()
+	assert.Equal(t, tx.ErrBadSignature, errors.Cause(tampered.ValidateTransaction(utxos, 1)))
+
+	assert.Equal(t, tx.ErrMissingTxOut, errors.Cause(valid.ValidateTransaction(tx.UnspentTxOuts{}, 1)))
+}
+
+func TestValidateTransaction_OverflowingOutputs(t *testing.T) {
+	address, err := tx.GetPublicKey(PRIVATE_KEY)
+	assert.Nil(t, err)
+	utxos := tx.UnspentTxOuts{{TxOutId: "1", TxOutIndex: 0, Address: address, Amount: 50}}
+
+	// the outputs wrap around to a sum of -2, below the input
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: math.MaxInt64}, {Address: ADDRESS, Amount: math.MaxInt64}},
+	}
+	transaction.Id = transaction.GetTransactionId()
+	signature, err := transaction.SignTxIn(0, PRIVATE_KEY, utxos)
+	assert.Nil(t, err)
+	transaction.TxIns[0].Signature = signature
+
+	_, err = transaction.GetFee(utxos)
+	assert.Equal(t, tx.ErrAmountOutOfRange, errors.Cause(err))
+	assert.Equal(t, tx.ErrAmountOutOfRange, errors.Cause(transaction.ValidateTransaction(utxos, 1)))
+
+	_, err = tx.GetTotalFees([]tx.Transaction{transaction}, utxos)
+	assert.Equal(t, tx.ErrAmountOutOfRange, errors.Cause(err))
+
+	coinbase := tx.GetCoinbaseTransaction(ADDRESS, 1)
+	_, err = tx.ProcessTransactions([]tx.Transaction{coinbase, transaction}, utxos, 1, 0)
+	assert.Equal(t, tx.ErrAmountOutOfRange, errors.Cause(err))
+}
+
+func TestGetTotalFees_AboveMaxMoney(t *testing.T) {
+	utxos := tx.UnspentTxOuts{
+		{TxOutId: "1", TxOutIndex: 0, Address: ADDRESS, Amount: tx.MAX_MONEY},
+		{TxOutId: "2", TxOutIndex: 0, Address: ADDRESS, Amount: 1},
+	}
+	transactions := []tx.Transaction{
+		{Id: "a", TxIns: []tx.TxIn{{TxOutId: "1", TxOutIndex: 0}}},
+		{Id: "b", TxIns: []tx.TxIn{{TxOutId: "2", TxOutIndex: 0}}},
+	}
+
+	fee, err := transactions[0].GetFee(utxos)
+	assert.Nil(t, err)
+	assert.Equal(t, tx.MAX_MONEY, fee)
+
+	_, err = tx.GetTotalFees(transactions, utxos)
+	assert.Equal(t, tx.ErrAmountOutOfRange, errors.Cause(err))
+}
+
+func TestGetTransactionId_FieldBoundariesMatter(t *testing.T) {
+	// both concatenate to the same text without lengths
+	a := tx.Transaction{TxIns: []tx.TxIn{{TxOutId: "ab", TxOutIndex: 12}}}
+	b := tx.Transaction{TxIns: []tx.TxIn{{TxOutId: "ab1", TxOutIndex: 2}}}
+
+	assert.NotEqual(t, a.GetTransactionId(), b.GetTransactionId())
+}
+
+func TestTransaction_MarshalBinary_ThenUnmarshalBinary(t *testing.T) {
+	transaction := tx.Transaction{
+		TxIns:  []tx.TxIn{{TxOutId: "1", TxOutIndex: 0, Signature: "3045"}, {TxOutId: "2", TxOutIndex: 3}},
+		TxOuts: []tx.TxOut{{Address: ADDRESS, Amount: 10}, {Address: ADDRESS, Amount: 5}},
+	}
+	transaction.Id = transaction.GetTransactionId()
+
+	data, err := transaction.MarshalBinary()
+	assert.Nil(t, err)
+
+	var decoded tx.Transaction
+	assert.Nil(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, transaction, decoded)
+
+	// the id does not cover the signatures
+	decoded.TxIns[0].Signature = ""
+	assert.Equal(t, transaction.Id, decoded.GetTransactionId())
+
+	assert.NotNil(t, decoded.UnmarshalBinary(data[:len(data)-1]))
+	assert.NotNil(t, decoded.UnmarshalBinary(append(data, 0)))
+}
@@ -45,28 +45,53 @@ func InitWallet() {
 	}
 }
 
-func GetBalance(address string, unspentTxOuts tx.UnspentTxOuts) int64 {
+// GetBalance returns what address can spend in the block at spendHeight and
+// what it holds in coinbase outputs that are not mature yet.
+func GetBalance(address string, unspentTxOuts tx.UnspentTxOuts, spendHeight int64) (int64, int64) {
 	utxos := FindUnspentTxOuts(address, unspentTxOuts)
-	return From(utxos).Select(func(i interface{}) interface{} {
+
+	spendable := From(utxos).Where(func(i interface{}) bool {
+		utxo := i.(tx.UnspentTxOut)
+		return utxo.IsMature(spendHeight)
+	}).Select(func(i interface{}) interface{} {
+		utxo := i.(tx.UnspentTxOut)
+		return utxo.Amount
+	}).SumInts()
+
+	total := From(utxos).Select(func(i interface{}) interface{} {
 		utxo := i.(tx.UnspentTxOut)
 		return utxo.Amount
 	}).SumInts()
+
+	return spendable, total - spendable
 }
 
+// FindUnspentTxOuts returns the outputs paying to address. When address is
+// a public key, that includes those paying to its hash.
 func FindUnspentTxOuts(address string, unspentTxOuts tx.UnspentTxOuts) tx.UnspentTxOuts {
+	pubKeyHashAddress, err := tx.PayToPubKeyHashAddress(address)
+	if err != nil {
+		pubKeyHashAddress = address
+	}
+
 	var utxos tx.UnspentTxOuts
 	From(unspentTxOuts).Where(func(i interface{}) bool {
 		utxo := i.(tx.UnspentTxOut)
-		return utxo.Address == address
+		return utxo.Address == address || utxo.Address == pubKeyHashAddress
 	}).ToSlice(&utxos)
 	return utxos
 }
 
-func FindTxOutsForAmount(amount int64, myUnspentTxOuts tx.UnspentTxOuts) (tx.UnspentTxOuts, int64, error) {
+// FindTxOutsForAmount picks outputs worth at least amount among those that
+// can be spent in the block at spendHeight, and returns the change.
+func FindTxOutsForAmount(amount int64, myUnspentTxOuts tx.UnspentTxOuts, spendHeight int64) (tx.UnspentTxOuts, int64, error) {
 	currentAmount := int64(0)
 	lastAmount := int64(0)
 	var includedUnspentTxOuts tx.UnspentTxOuts
-	From(myUnspentTxOuts).TakeWhile(func(i interface{}) bool {
+	From(myUnspentTxOuts).Where(func(i interface{}) bool {
+		utxo := i.(tx.UnspentTxOut)
+		return utxo.IsMature(spendHeight)
+	}).TakeWhile(func(i interface{}) bool {
 		utxo := i.(tx.UnspentTxOut)
 		lastAmount = currentAmount
 		currentAmount += utxo.Amount
@@ -78,7 +103,7 @@ func FindTxOutsForAmount(amount int64, myUnspentTxOuts tx.UnspentTxOuts) (tx.Uns
 	}
 
 	if lastAmount < amount {
-		msg := fmt.Sprintf("Cannot create transaction from the available unspent transaction outputs. Required amount: %d Avaliable unspentUtxos %v", amount, myUnspentTxOuts)
+		msg := fmt.Sprintf("Cannot create transaction from the available unspent transaction outputs. Required amount: %d Avaliable unspentUtxos %v, coinbase outputs only count once mature", amount, myUnspentTxOuts)
 		return nil, 0, errors.New(msg)
 	} else {
 		return includedUnspentTxOuts,  lastAmount - amount, nil
@@ -117,19 +142,61 @@ func filterTxPoolTxs(unspentTxOuts tx.UnspentTxOuts, transactionPool tx.Transact
 	return filteredUtxos
 }
 
-func CreateTransaction(receiverAddress string, amount int64, privateKey string, unspentTxOuts tx.UnspentTxOuts, txPool tx.TransactionPool) (*tx.Transaction, error) {
-	log.Printf("txPool: %v", txPool)
-
+// CreateTransaction sends amount to receiverAddress and leaves fee to the
+// miner, the change goes back to the wallet. It only spends outputs that are
+// mature at spendHeight, the height of the next block.
+func CreateTransaction(receiverAddress string, amount int64, fee int64, privateKey string, unspentTxOuts tx.UnspentTxOuts, txPool tx.TransactionPool, spendHeight int64) (*tx.Transaction, error) {
 	myAddress, err := tx.GetPublicKey(privateKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "CreateTransaction-GetPublicKey")
 	}
 
+	changeAddress, err := tx.PayToPubKeyHashAddress(myAddress)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateTransaction-PayToPubKeyHashAddress")
+	}
+
+	transaction, err := createUnsignedTransaction(myAddress, changeAddress, receiverAddress, amount, fee, unspentTxOuts, txPool, spendHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	var signedTxIns []tx.TxIn
+	From(transaction.TxIns).SelectIndexed(func(index int, i interface{}) interface{} {
+		txIn := i.(tx.TxIn)
+		signature, err := transaction.SignTxIn(int64(index), privateKey, unspentTxOuts)
+		if err != nil {
+			panic(transaction)
+		}
+		txIn.Signature = signature
+		return txIn
+	}).ToSlice(&signedTxIns)
+
+	transaction.TxIns = signedTxIns
+
+	return transaction, nil
+
+}
+
+// createUnsignedTransaction spends outputs of fromAddress to send amount to
+// receiverAddress, the change goes to changeAddress.
+func createUnsignedTransaction(fromAddress string, changeAddress string, receiverAddress string, amount int64, fee int64, unspentTxOuts tx.UnspentTxOuts, txPool tx.TransactionPool, spendHeight int64) (*tx.Transaction, error) {
+	if amount <= 0 {
+		return nil, errors.New("amount must be positive")
+	} else if fee < 0 {
+		return nil, errors.New("fee must not be negative")
+	}
+
+	if _, err := tx.ParseLockingScript(receiverAddress); err != nil {
+		return nil, errors.Wrap(err, "invalid receiver address")
+	}
+
+	log.Printf("txPool: %v", txPool)
 
-	myUnspentTxOutsA := FindUnspentTxOuts(myAddress, unspentTxOuts)
+	myUnspentTxOutsA := FindUnspentTxOuts(fromAddress, unspentTxOuts)
 	myUnspentTxOuts := filterTxPoolTxs(myUnspentTxOutsA, txPool)
 
-	includedUnspentTxOuts, leftOverAmount, err := FindTxOutsForAmount(amount, myUnspentTxOuts)
+	includedUnspentTxOuts, leftOverAmount, err := FindTxOutsForAmount(amount+fee, myUnspentTxOuts, spendHeight)
 	if err != nil {
 		return nil,  errors.Wrap(err, "CreateTransaction-FindTxOutsForAmount")
 	}
@@ -140,7 +207,7 @@ func CreateTransaction(receiverAddress string, amount int64, privateKey string,
 		return tx.TxIn{TxOutId: utxo.TxOutId, TxOutIndex: utxo.TxOutIndex}
 	}).ToSlice(&unsignedTxIns)
 
-	txOuts := CreateTxOuts(receiverAddress, myAddress, amount, leftOverAmount)
+	txOuts := CreateTxOuts(receiverAddress, changeAddress, amount, leftOverAmount)
 
 	transaction := tx.Transaction{
 		TxIns:  unsignedTxIns,
@@ -149,19 +216,119 @@ func CreateTransaction(receiverAddress string, amount int64, privateKey string,
 
 	transaction.Id = transaction.GetTransactionId()
 
-	var signedTxIns []tx.TxIn
-	From(unsignedTxIns).SelectIndexed(func(index int, i interface{}) interface{} {
-		txIn := i.(tx.TxIn)
-		signature, err := transaction.SignTxIn(int64(index), privateKey, unspentTxOuts)
-		if err != nil {
-			panic(transaction)
+	return &transaction, nil
+}
+
+// CreateMultisigAddress returns the address of outputs that required of the
+// publicKeys must sign to spend.
+func CreateMultisigAddress(required int, publicKeys []string) (string, error) {
+	return tx.MultisigAddress(required, publicKeys)
+}
+
+// CreateMultisigSpend builds the unsigned transaction sending amount from
+// multisigAddress to receiverAddress, the change goes back to
+// multisigAddress. Each co-signer signs it with CosignTransaction, then
+// FinalizeTransaction makes it valid.
+func CreateMultisigSpend(multisigAddress string, receiverAddress string, amount int64, fee int64, unspentTxOuts tx.UnspentTxOuts, txPool tx.TransactionPool, spendHeight int64) (*tx.Transaction, error) {
+	if _, _, ok := tx.ParseMultisigAddress(multisigAddress); !ok {
+		return nil, errors.Errorf("%s is not a multisig address", multisigAddress)
+	}
+
+	return createUnsignedTransaction(multisigAddress, multisigAddress, receiverAddress, amount, fee, unspentTxOuts, txPool, spendHeight)
+}
+
+// CosignTransaction adds the signature of privateKey to every input of
+// transaction spending a multisig output that it is a key of. It returns
+// the number of inputs signed.
+func CosignTransaction(transaction *tx.Transaction, privateKey string, unspentTxOuts tx.UnspentTxOuts, hashType tx.SigHashType) (int, error) {
+	myAddress, err := tx.GetPublicKey(privateKey)
+	if err != nil {
+		return 0, errors.Wrap(err, "CosignTransaction-GetPublicKey")
+	}
+
+	signed := 0
+	for index, txIn := range transaction.TxIns {
+		utxo, found := From(unspentTxOuts).FirstWith(func(i interface{}) bool {
+			utxo := i.(tx.UnspentTxOut)
+			return utxo.TxOutId == txIn.TxOutId && utxo.TxOutIndex == txIn.TxOutIndex
+		}).(tx.UnspentTxOut)
+		if !found {
+			continue
 		}
-		txIn.Signature = signature
-		return txIn
-	}).ToSlice(&signedTxIns)
 
-	transaction.TxIns = signedTxIns
+		_, publicKeys, ok := tx.ParseMultisigAddress(utxo.Address)
+		if !ok || !From(publicKeys).Contains(myAddress) {
+			continue
+		}
 
-	return &transaction, nil
+		if err := transaction.SignMultisigTxIn(int64(index), privateKey, unspentTxOuts, hashType); err != nil {
+			return signed, errors.Wrapf(err, "CosignTransaction- txIn %d", index)
+		}
+		signed++
+	}
+
+	return signed, nil
+}
+
+// FinalizeTransaction turns the signatures collected on the multisig inputs
+// of transaction into their unlocking scripts.
+func FinalizeTransaction(transaction *tx.Transaction, unspentTxOuts tx.UnspentTxOuts) error {
+	for index, txIn := range transaction.TxIns {
+		utxo, found := From(unspentTxOuts).FirstWith(func(i interface{}) bool {
+			utxo := i.(tx.UnspentTxOut)
+			return utxo.TxOutId == txIn.TxOutId && utxo.TxOutIndex == txIn.TxOutIndex
+		}).(tx.UnspentTxOut)
+		if !found {
+			return errors.Wrapf(tx.ErrMissingTxOut, "FinalizeTransaction- txIn %s:%d", txIn.TxOutId, txIn.TxOutIndex)
+		}
 
+		if _, _, ok := tx.ParseMultisigAddress(utxo.Address); !ok {
+			continue
+		}
+
+		if err := transaction.FinalizeMultisigTxIn(int64(index), unspentTxOuts); err != nil {
+			return errors.Wrap(err, "FinalizeTransaction")
+		}
+	}
+
+	transaction.Id = transaction.GetTransactionId()
+	return nil
+}
+
+// SignTransaction signs, with hashType, every unsigned input of transaction
+// that spends an output of the address of privateKey, so that several
+// wallets can each sign their own inputs of a shared transaction. It returns
+// the number of inputs signed.
+func SignTransaction(transaction *tx.Transaction, privateKey string, unspentTxOuts tx.UnspentTxOuts, hashType tx.SigHashType) (int, error) {
+	myAddress, err := tx.GetPublicKey(privateKey)
+	if err != nil {
+		return 0, errors.Wrap(err, "SignTransaction-GetPublicKey")
+	}
+	myUnspentTxOuts := FindUnspentTxOuts(myAddress, unspentTxOuts)
+
+	signed := 0
+	for index := range transaction.TxIns {
+		txIn := &transaction.TxIns[index]
+		if txIn.Signature != "" {
+			continue
+		}
+
+		mine := From(myUnspentTxOuts).AnyWith(func(i interface{}) bool {
+			utxo := i.(tx.UnspentTxOut)
+			return utxo.TxOutId == txIn.TxOutId && utxo.TxOutIndex == txIn.TxOutIndex
+		})
+		if !mine {
+			continue
+		}
+
+		signature, err := transaction.SignTxInWithType(int64(index), privateKey, unspentTxOuts, hashType)
+		if err != nil {
+			return signed, errors.Wrapf(err, "SignTransaction- txIn %d", index)
+		}
+		txIn.Signature = signature
+		signed++
+	}
+
+	transaction.Id = transaction.GetTransactionId()
+	return signed, nil
 }
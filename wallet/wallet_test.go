@@ -3,6 +3,7 @@ package wallet
 import (
 	"testing"
 	"github.com/stretchr/testify/assert"
+	"github.com/go-naivecoin/tx"
 )
 
 func TestGetPublicKey(t *testing.T) {
@@ -11,4 +12,54 @@ func TestGetPublicKey(t *testing.T) {
 
 	assert.Nil(t, err)
 	assert.NotEmpty(t, key)
-}
\ No newline at end of file
+}
+func TestMultisigWorkflow(t *testing.T) {
+	privateKeys := []string{
+		"0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9",
+		"1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90a",
+		"2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90a1b",
+	}
+	var publicKeys []string
+	for _, privateKey := range privateKeys {
+		publicKey, err := tx.GetPublicKey(privateKey)
+		assert.Nil(t, err)
+		publicKeys = append(publicKeys, publicKey)
+	}
+
+	address, err := CreateMultisigAddress(2, publicKeys)
+	assert.Nil(t, err)
+	utxos := tx.UnspentTxOuts{{TxOutId: "1", TxOutIndex: 0, Address: address, Amount: 50}}
+
+	transaction, err := CreateMultisigSpend(address, publicKeys[0], 30, 1, utxos, tx.TransactionPool{}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, address, transaction.TxOuts[1].Address)
+	assert.Equal(t, int64(19), transaction.TxOuts[1].Amount)
+
+	signed, err := CosignTransaction(transaction, privateKeys[1], utxos, tx.SIGHASH_ALL)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, signed)
+	assert.NotNil(t, FinalizeTransaction(transaction, utxos))
+
+	_, err = CosignTransaction(transaction, privateKeys[2], utxos, tx.SIGHASH_ALL)
+	assert.Nil(t, err)
+	assert.Nil(t, FinalizeTransaction(transaction, utxos))
+	assert.Nil(t, transaction.ValidateTransaction(utxos, 1))
+
+	_, err = CreateMultisigSpend(publicKeys[0], publicKeys[1], 30, 1, utxos, tx.TransactionPool{}, 1)
+	assert.NotNil(t, err)
+}
+
+func TestCreateTransaction_InvalidReceiver(t *testing.T) {
+	privateKey := "0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+	publicKey, err := tx.GetPublicKey(privateKey)
+	assert.Nil(t, err)
+	utxos := tx.UnspentTxOuts{{TxOutId: "1", TxOutIndex: 0, Address: publicKey, Amount: 50}}
+
+	pubKeyHash, err := tx.PayToPubKeyHashAddress(publicKey)
+	assert.Nil(t, err)
+	_, err = CreateTransaction(pubKeyHash, 10, 0, privateKey, utxos, tx.TransactionPool{}, 1)
+	assert.Nil(t, err)
+
+	_, err = CreateTransaction(publicKey[:129], 10, 0, privateKey, utxos, tx.TransactionPool{}, 1)
+	assert.NotNil(t, err)
+}
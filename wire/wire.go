@@ -0,0 +1,157 @@
+// Package wire holds the primitives of the canonical binary encoding of
+// transactions and blocks: fixed size little endian integers, and strings
+// and lists prefixed with their length as an unsigned varint.
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var ErrTrailingBytes = errors.New("trailing bytes after the encoded value")
+
+// Writer appends values to a buffer.
+type Writer struct {
+	buf bytes.Buffer
+}
+
+func (w *Writer) WriteUvarint(v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	w.buf.Write(scratch[:n])
+}
+
+func (w *Writer) WriteUint32(v uint32) {
+	var scratch [4]byte
+	binary.LittleEndian.PutUint32(scratch[:], v)
+	w.buf.Write(scratch[:])
+}
+
+func (w *Writer) WriteInt64(v int64) {
+	var scratch [8]byte
+	binary.LittleEndian.PutUint64(scratch[:], uint64(v))
+	w.buf.Write(scratch[:])
+}
+
+func (w *Writer) WriteBytes(b []byte) {
+	w.WriteUvarint(uint64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *Writer) WriteString(s string) {
+	w.WriteUvarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+// Bytes returns what was written so far.
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// Reader reads values back from an encoding. The first error sticks: later
+// reads return zero values and Err reports it.
+type Reader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func NewReader(data []byte) *Reader {
+	return &Reader{r: bytes.NewReader(data)}
+}
+
+func (r *Reader) fail(err error, what string) {
+	if r.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = errors.Wrapf(err, "reading %s", what)
+	}
+}
+
+func (r *Reader) ReadUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.fail(err, "varint")
+	}
+	return v
+}
+
+func (r *Reader) ReadUint32() uint32 {
+	var scratch [4]byte
+	if r.read(scratch[:], "uint32") {
+		return binary.LittleEndian.Uint32(scratch[:])
+	}
+	return 0
+}
+
+func (r *Reader) ReadInt64() int64 {
+	var scratch [8]byte
+	if r.read(scratch[:], "int64") {
+		return int64(binary.LittleEndian.Uint64(scratch[:]))
+	}
+	return 0
+}
+
+func (r *Reader) ReadBytes() []byte {
+	length := r.ReadCount(1)
+	b := make([]byte, length)
+	if r.read(b, "bytes") {
+		return b
+	}
+	return nil
+}
+
+func (r *Reader) ReadString() string {
+	return string(r.ReadBytes())
+}
+
+// ReadCount reads the length of a list whose items take at least minSize
+// bytes each, rejecting lengths the remaining bytes cannot hold.
+func (r *Reader) ReadCount(minSize int) int {
+	count := r.ReadUvarint()
+	if r.err != nil {
+		return 0
+	}
+
+	if minSize < 1 {
+		minSize = 1
+	}
+	if count > uint64(r.r.Len()/minSize) {
+		r.fail(io.ErrUnexpectedEOF, "list")
+		return 0
+	}
+	return int(count)
+}
+
+func (r *Reader) read(b []byte, what string) bool {
+	if r.err != nil {
+		return false
+	}
+
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.fail(err, what)
+		return false
+	}
+	return true
+}
+
+// Err returns the first error met while reading.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Close returns the first error met while reading, or ErrTrailingBytes when
+// the encoding holds more than was read.
+func (r *Reader) Close() error {
+	if r.err == nil && r.r.Len() > 0 {
+		return ErrTrailingBytes
+	}
+	return r.err
+}
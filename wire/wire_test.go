@@ -0,0 +1,33 @@
+package wire_test
+
+import (
+	"testing"
+
+	"github.com/go-naivecoin/wire"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter_ThenReader(t *testing.T) {
+	var w wire.Writer
+	w.WriteUint32(7)
+	w.WriteInt64(-2)
+	w.WriteString("naivecoin")
+	w.WriteUvarint(300)
+
+	r := wire.NewReader(w.Bytes())
+	assert.Equal(t, uint32(7), r.ReadUint32())
+	assert.Equal(t, int64(-2), r.ReadInt64())
+	assert.Equal(t, "naivecoin", r.ReadString())
+	assert.Equal(t, uint64(300), r.ReadUvarint())
+	assert.Nil(t, r.Close())
+}
+
+func TestReader_LengthBeyondInput_ThenError(t *testing.T) {
+	var w wire.Writer
+	w.WriteUvarint(1 << 40)
+
+	r := wire.NewReader(w.Bytes())
+	assert.Equal(t, "", r.ReadString())
+	assert.NotNil(t, r.Err())
+	assert.Equal(t, int64(0), r.ReadInt64())
+}